@@ -18,46 +18,191 @@ package core
 
 import (
 	"container/heap"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
 	"math/big"
+	"runtime"
 	"sort"
+	"sync"
+	"time"
 
+	"github.com/gochain/gochain/v4/common"
 	"github.com/gochain/gochain/v4/core/types"
+	"github.com/gochain/gochain/v4/crypto"
+	"github.com/gochain/gochain/v4/internal/heaputil"
+	"github.com/gochain/gochain/v4/metrics"
+	"github.com/gochain/gochain/v4/rlp"
 )
 
+// sortedMapRebuildCounter counts the sorts of txSortedMap caches, exposing
+// workloads that interleave mutations and flattens on large accounts.
+var sortedMapRebuildCounter = metrics.NewRegisteredCounter("txpool/sortedmap/rebuilds", nil)
+
 // nonceHeap is a heap.Interface implementation over 64bit unsigned integers for
-// retrieving sorted transactions from the possibly gapped future queue.
-type nonceHeap []uint64
+// retrieving sorted transactions from the possibly gapped future queue. The heap
+// position of every nonce is tracked to allow removing arbitrary nonces without
+// scanning the heap.
+//
+// Nonces are ordered purely by value. Every nonce is stored at most once (which
+// Push asserts in race builds), and even if equal nonces coexisted they would be
+// indistinguishable, so the ordering is deterministic without a secondary key.
+type nonceHeap struct {
+	heaputil.Uint64Heap
+	pos map[uint64]int // Position of each nonce within the heap
+}
 
-func (h nonceHeap) Len() int           { return len(h) }
-func (h nonceHeap) Less(i, j int) bool { return h[i] < h[j] }
-func (h nonceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+// newNonceHeap creates an empty nonce heap with room for n nonces.
+func newNonceHeap(n int) *nonceHeap {
+	h := &nonceHeap{pos: make(map[uint64]int, n)}
+	h.Values = make([]uint64, 0, n)
+	h.SetIndex = func(nonce uint64, i int) {
+		if i < 0 {
+			delete(h.pos, nonce)
+		} else {
+			h.pos[nonce] = i
+		}
+	}
+	return h
+}
 
+// Push adds a nonce to the heap. In race builds it panics if the nonce is already
+// present, catching callers pushing a nonce twice instead of overwriting it.
 func (h *nonceHeap) Push(x interface{}) {
-	*h = append(*h, x.(uint64))
+	if txListDebug {
+		if _, ok := h.pos[x.(uint64)]; ok {
+			panic(fmt.Sprintf("duplicate nonce %d pushed to heap", x.(uint64)))
+		}
+	}
+	h.Uint64Heap.Push(x)
 }
 
-func (h *nonceHeap) Pop() interface{} {
-	old := *h
-	n := len(old)
-	x := old[n-1]
-	*h = old[0 : n-1]
-	return x
+// remove deletes the given nonce from the heap, returning whether it was present.
+func (h *nonceHeap) remove(nonce uint64) bool {
+	i, ok := h.pos[nonce]
+	if !ok {
+		return false
+	}
+	heap.Remove(h, i)
+	return true
+}
+
+// truncate drops all but the first n nonces, which must be followed by a
+// heap.Init if the remainder is not already heap ordered.
+func (h *nonceHeap) truncate(n int) {
+	for _, nonce := range h.Values[n:] {
+		delete(h.pos, nonce)
+	}
+	h.Values = h.Values[:n]
 }
 
+// txClock is a source of wall clock time used to timestamp transaction arrivals.
+type txClock interface {
+	Now() time.Time
+}
+
+// systemClock is a txClock backed by the system time.
+type systemClock struct{}
+
+// Now returns the current local time.
+func (systemClock) Now() time.Time { return time.Now() }
+
 // txSortedMap is a nonce->transaction hash map with a heap based index to allow
 // iterating over the contents in a nonce-incrementing way.
 type txSortedMap struct {
-	items map[uint64]*types.Transaction // Hash map storing the transaction data
-	index *nonceHeap                    // Heap of nonces of all the stored transactions (non-strict mode)
-	cache types.Transactions            // Cache of the transactions already sorted
+	items    map[uint64]*types.Transaction // Hash map storing the transaction data
+	hashes   map[common.Hash]uint64        // Nonces of the stored transactions, keyed by hash
+	index    *nonceHeap                    // Heap of nonces of all the stored transactions (non-strict mode)
+	cache    types.Transactions            // Cache of the transactions already sorted
+	cacheMu  sync.Mutex                    // Lock guarding the lazy creation of the cache by readers
+	gen      uint64                        // Mutation counter, bumped whenever the contents change
+	arrivals map[uint64]time.Time          // Time each stored transaction was inserted at
+	clock    txClock                       // Clock used to timestamp the arrivals
+
+	countCmps bool            // Whether to count the comparisons made while sorting the cache
+	cmps      uint64          // Number of comparisons made while sorting the cache
+	cacheMgr  *txCacheManager // Optional manager bounding the memory of caches across maps
+
+	priorities map[uint64]uint8 // Eviction priorities of the stored transactions (absent = 0)
+	onDelete   func(uint64)     // Optional callback fired with the nonce of every deleted transaction
+
+	cost *big.Int // Running sum of the costs of all the stored transactions
+	gas  uint64   // Running sum of the gas limits of all the stored transactions
 }
 
 // newTxSortedMap creates a new nonce-sorted transaction map.
 func newTxSortedMap() *txSortedMap {
+	return newTxSortedMapCap(0)
+}
+
+// newTxSortedMapCap creates a new nonce-sorted transaction map with room for n
+// transactions, avoiding repeated growth when many are known to arrive.
+func newTxSortedMapCap(n int) *txSortedMap {
 	return &txSortedMap{
-		items: make(map[uint64]*types.Transaction),
-		index: &nonceHeap{},
+		items:    make(map[uint64]*types.Transaction, n),
+		hashes:   make(map[common.Hash]uint64, n),
+		index:    newNonceHeap(n),
+		arrivals: make(map[uint64]time.Time, n),
+		cost:     new(big.Int),
+		clock:    systemClock{},
+	}
+}
+
+// Clone returns an independent copy of the map, including its nonce heap and,
+// if present, the sorted cache. Transactions are immutable so they are shared.
+// The clone is not registered with any cache manager, nor does it inherit the
+// deletion callback.
+func (m *txSortedMap) Clone() *txSortedMap {
+	clone := &txSortedMap{
+		items:     make(map[uint64]*types.Transaction, len(m.items)),
+		hashes:    make(map[common.Hash]uint64, len(m.hashes)),
+		index:     newNonceHeap(len(m.items)),
+		gen:       m.gen,
+		arrivals:  make(map[uint64]time.Time, len(m.arrivals)),
+		clock:     m.clock,
+		countCmps: m.countCmps,
+		cost:      new(big.Int).Set(m.cost),
+		gas:       m.gas,
 	}
+	for nonce, tx := range m.items {
+		clone.items[nonce] = tx
+	}
+	for hash, nonce := range m.hashes {
+		clone.hashes[hash] = nonce
+	}
+	for nonce, arrival := range m.arrivals {
+		clone.arrivals[nonce] = arrival
+	}
+	if len(m.priorities) > 0 {
+		clone.priorities = make(map[uint64]uint8, len(m.priorities))
+		for nonce, priority := range m.priorities {
+			clone.priorities[nonce] = priority
+		}
+	}
+	clone.index.Values = append(clone.index.Values, m.index.Values...)
+	for nonce, i := range m.index.pos {
+		clone.index.pos[nonce] = i
+	}
+	if m.cache != nil {
+		clone.cache = make(types.Transactions, len(m.cache))
+		copy(clone.cache, m.cache)
+	}
+	return clone
+}
+
+// Equal reports whether both maps hold the same transactions under the same
+// nonces, compared by hash. The heap ordering and cache presence are ignored.
+func (m *txSortedMap) Equal(other *txSortedMap) bool {
+	if len(m.items) != len(other.items) {
+		return false
+	}
+	for nonce, tx := range m.items {
+		if otx, ok := other.items[nonce]; !ok || otx.Hash() != tx.Hash() {
+			return false
+		}
+	}
+	return true
 }
 
 // Get retrieves the current transactions associated with the given nonce.
@@ -65,32 +210,197 @@ func (m *txSortedMap) Get(nonce uint64) *types.Transaction {
 	return m.items[nonce]
 }
 
+// GetByHash retrieves the stored transaction with the given hash, or nil if it is
+// not in the map.
+func (m *txSortedMap) GetByHash(hash common.Hash) *types.Transaction {
+	nonce, ok := m.hashes[hash]
+	if !ok {
+		return nil
+	}
+	return m.items[nonce]
+}
+
+// Contains returns whether a transaction with the given nonce is stored.
+func (m *txSortedMap) Contains(nonce uint64) bool {
+	_, ok := m.items[nonce]
+	return ok
+}
+
+// Peek returns the transaction with the lowest nonce without removing it, or nil
+// if the map is empty.
+func (m *txSortedMap) Peek() *types.Transaction {
+	if cache := m.cached(); len(cache) > 0 {
+		return cache[0]
+	}
+	if m.index.Len() == 0 {
+		return nil
+	}
+	return m.items[m.index.Peek()]
+}
+
 // Put inserts a new transaction into the map, also updating the map's nonce
 // index. If a transaction already exists with the same nonce, it's overwritten.
 func (m *txSortedMap) Put(tx *types.Transaction) {
 	nonce := tx.Nonce()
-	if m.items[nonce] == nil {
-		heap.Push(m.index, nonce)
+	if m.items[nonce] != nil {
+		m.set(tx)
+		return
+	}
+	heap.Push(m.index, nonce)
+
+	// If a new highest nonce is appended, keep the cache in order instead of
+	// dropping it, sparing sequential inserts a full resort
+	if n := len(m.cache); m.cache != nil && (n == 0 || m.cache[n-1].Nonce() < nonce) {
+		cache := append(m.cache, tx)
+		m.set(tx)
+		m.cache = cache
+		return
+	}
+	m.set(tx)
+}
+
+// PutPriority inserts a new transaction into the map like Put, tagging it with an
+// eviction priority. Cap evicts the lowest priority transactions first, highest
+// nonce first among equals. Transactions inserted via Put have priority 0.
+func (m *txSortedMap) PutPriority(tx *types.Transaction, priority uint8) {
+	m.Put(tx)
+	if priority > 0 {
+		if m.priorities == nil {
+			m.priorities = make(map[uint64]uint8)
+		}
+		m.priorities[tx.Nonce()] = priority
+	}
+}
+
+// set inserts a new transaction into the map like Put, but leaves maintaining
+// the nonce index to the caller, allowing it to be rebuilt once after a batch.
+func (m *txSortedMap) set(tx *types.Transaction) {
+	nonce := tx.Nonce()
+	if old := m.items[nonce]; old != nil {
+		delete(m.hashes, old.Hash())
+		m.cost.Sub(m.cost, old.Cost())
+		m.gas -= old.Gas()
 	}
 	m.items[nonce], m.cache = tx, nil
+	m.cost.Add(m.cost, tx.Cost())
+	m.gas += tx.Gas()
+	m.hashes[tx.Hash()] = nonce
+	m.arrivals[nonce] = m.clock.Now()
+	delete(m.priorities, nonce)
+	m.gen++
+}
+
+// reheap rebuilds the nonce heap from the stored transactions.
+func (m *txSortedMap) reheap() {
+	m.index.Values = make([]uint64, 0, len(m.items))
+	m.index.pos = make(map[uint64]int, len(m.items))
+	for nonce := range m.items {
+		m.index.pos[nonce] = len(m.index.Values)
+		m.index.Values = append(m.index.Values, nonce)
+	}
+	heap.Init(m.index)
+}
+
+// del deletes the transaction with the given nonce along with all of its
+// metadata, leaving the heap and cache maintenance to the caller.
+func (m *txSortedMap) del(nonce uint64) {
+	if tx := m.items[nonce]; tx != nil {
+		delete(m.hashes, tx.Hash())
+		m.cost.Sub(m.cost, tx.Cost())
+		m.gas -= tx.Gas()
+	}
+	delete(m.items, nonce)
+	delete(m.arrivals, nonce)
+	delete(m.priorities, nonce)
+	if m.onDelete != nil {
+		m.onDelete(nonce)
+	}
+}
+
+// clear removes all transactions from the map.
+func (m *txSortedMap) clear() {
+	if m.onDelete != nil {
+		for nonce := range m.items {
+			m.onDelete(nonce)
+		}
+	}
+	m.items = make(map[uint64]*types.Transaction)
+	m.hashes = make(map[common.Hash]uint64)
+	m.arrivals = make(map[uint64]time.Time)
+	m.priorities = nil
+	m.index.truncate(0)
+	m.cache = nil
+	m.cost, m.gas = new(big.Int), 0
+	m.gen++
 }
 
 // Forward removes all transactions from the map with a nonce lower than the
 // provided threshold. Every removed transaction is passed to fn for any post-removal
-// maintenance.
-func (m *txSortedMap) Forward(threshold uint64, fn func(*types.Transaction)) {
+// maintenance, and the number of removed transactions is returned.
+func (m *txSortedMap) Forward(threshold uint64, fn func(*types.Transaction)) int {
 	var removed int
 	// Pop off heap items until the threshold is reached
-	for m.index.Len() > 0 && (*m.index)[0] < threshold {
+	for m.index.Len() > 0 && m.index.Peek() < threshold {
 		nonce := heap.Pop(m.index).(uint64)
 		item := m.items[nonce]
-		delete(m.items, nonce)
+		m.del(nonce)
 		fn(item)
 		removed++
 	}
-	// If we had a cached order, shift the front
+	if removed > 0 {
+		m.gen++
+	}
+	// If we had a cached order, shift the front. The removed transactions must be
+	// exactly the cached ones below the threshold, otherwise the heap and cache
+	// disagree and the cache is dropped to be rebuilt on demand.
 	if m.cache != nil {
-		m.cache = m.cache[removed:]
+		i := sort.Search(len(m.cache), func(i int) bool {
+			return m.cache[i].Nonce() >= threshold
+		})
+		if i == removed {
+			m.cache = m.cache[i:]
+		} else {
+			if txListDebug {
+				panic(fmt.Sprintf("cache misaligned on forward: %d cached below %d, %d removed", i, threshold, removed))
+			}
+			m.cache = nil
+		}
+	}
+	return removed
+}
+
+// ForwardApproved removes all transactions from the map with a nonce lower than the
+// provided threshold like Forward, except for those approve returns false for,
+// which are kept despite being below the threshold. A nil approve removes every
+// transaction below the threshold.
+func (m *txSortedMap) ForwardApproved(threshold uint64, approve func(*types.Transaction) bool, fn func(*types.Transaction)) {
+	if approve == nil {
+		m.Forward(threshold, fn)
+		return
+	}
+	var (
+		kept    []uint64
+		removed int
+	)
+	for m.index.Len() > 0 && m.index.Peek() < threshold {
+		nonce := heap.Pop(m.index).(uint64)
+		item := m.items[nonce]
+		if !approve(item) {
+			kept = append(kept, nonce)
+			continue
+		}
+		m.del(nonce)
+		fn(item)
+		removed++
+	}
+	for _, nonce := range kept {
+		heap.Push(m.index, nonce)
+	}
+	// The vetoed transactions may be interleaved with the removed ones, so the
+	// cached order can't simply be shifted
+	if removed > 0 {
+		m.gen++
+		m.cache = nil
 	}
 }
 
@@ -104,24 +414,26 @@ func (m *txSortedMap) Filter(filter func(*types.Transaction) bool, strict bool,
 			if !filter(tx) {
 				continue
 			}
-			delete(m.items, tx.Nonce())
+			m.gen++
+			m.del(tx.Nonce())
 			removed(tx)
 
-			if len(m.cache) > i+1 {
-				for _, tx := range m.cache[i+1:] {
-					delete(m.items, tx.Nonce())
-					invalid(tx)
-				}
+			// If the match is the highest nonce, nothing is invalidated and only
+			// it needs to be dropped from the heap.
+			if len(m.cache) == i+1 {
+				m.cache = m.cache[:i]
+				m.index.remove(tx.Nonce())
+				return
+			}
+			for _, tx := range m.cache[i+1:] {
+				m.del(tx.Nonce())
+				invalid(tx)
 			}
 
 			m.cache = m.cache[:i]
 
 			// Rebuild heap.
-			*m.index = make([]uint64, 0, len(m.items))
-			for nonce := range m.items {
-				*m.index = append(*m.index, nonce)
-			}
-			heap.Init(m.index)
+			m.reheap()
 
 			return
 		}
@@ -134,40 +446,67 @@ func (m *txSortedMap) Filter(filter func(*types.Transaction) bool, strict bool,
 			continue
 		}
 		matched = true
-		delete(m.items, nonce)
+		m.del(nonce)
 		removed(tx)
 	}
 
 	// If transactions were removed, the heap and cache are ruined
 	if matched {
-		*m.index = make([]uint64, 0, len(m.items))
-		for nonce := range m.items {
-			*m.index = append(*m.index, nonce)
-		}
-		heap.Init(m.index)
+		m.gen++
+		m.reheap()
 
 		m.cache = nil
 	}
 }
 
+// Select returns the nonce-sorted transactions the filter matches, leaving the
+// map untouched. The sorted cache is reused (or built) for the ordering.
+func (m *txSortedMap) Select(filter func(*types.Transaction) bool) types.Transactions {
+	m.ensureCache()
+	var matches types.Transactions
+	for _, tx := range m.cache {
+		if filter(tx) {
+			matches = append(matches, tx)
+		}
+	}
+	return matches
+}
+
 // Cap places a hard limit on the number of items, removing and calling removed with each transaction
-// exceeding that limit.
-func (m *txSortedMap) Cap(threshold int, removed func(*types.Transaction)) {
+// exceeding that limit. The number of removed transactions is returned.
+func (m *txSortedMap) Cap(threshold int, removed func(*types.Transaction)) int {
 	// Short circuit if the number of items is under the limit.
 	if len(m.items) <= threshold {
-		return
+		return 0
+	}
+	// If any transactions are prioritized, evict by priority first
+	if len(m.priorities) > 0 {
+		drops := len(m.items) - threshold
+		m.CapWithScorer(threshold, EvictByPriority, removed)
+		return drops
 	}
+	return m.capTail(threshold, removed)
+}
+
+// capTail places a hard limit on the number of items like Cap, but always drops
+// the highest nonce transactions, ignoring any priorities.
+func (m *txSortedMap) capTail(threshold int, removed func(*types.Transaction)) int {
+	// Short circuit if the number of items is under the limit.
+	if len(m.items) <= threshold {
+		return 0
+	}
+	m.gen++
 
 	// Resort the heap to drop the highest nonce'd transactions.
 	var drops int
-	sort.Sort(*m.index)
+	sort.Sort(m.index)
 	for size := len(m.items); size > threshold; size-- {
-		item := m.items[(*m.index)[size-1]]
-		delete(m.items, (*m.index)[size-1])
+		item := m.items[m.index.Values[size-1]]
+		m.del(m.index.Values[size-1])
 		removed(item)
 		drops++
 	}
-	*m.index = (*m.index)[:threshold]
+	m.index.truncate(threshold)
 	// Restore the heap.
 	heap.Init(m.index)
 
@@ -175,6 +514,56 @@ func (m *txSortedMap) Cap(threshold int, removed func(*types.Transaction)) {
 	if m.cache != nil {
 		m.cache = m.cache[:len(m.cache)-drops]
 	}
+	return drops
+}
+
+// CapWithScorer places a hard limit on the number of items like Cap, but evicts the
+// transactions with the lowest scores first, breaking ties by evicting the higher
+// nonce first. Every removed transaction is passed to removed.
+func (m *txSortedMap) CapWithScorer(threshold int, scorer EvictionScorer, removed func(*types.Transaction)) {
+	// Short circuit if the number of items is under the limit.
+	if len(m.items) <= threshold {
+		return
+	}
+	m.gen++
+
+	order := m.evictionOrder(scorer)
+	for _, tx := range order[:len(order)-threshold] {
+		m.del(tx.Nonce())
+		removed(tx)
+	}
+	// Rebuild heap, the evicted transactions may be anywhere in the order.
+	m.reheap()
+	m.cache = nil
+}
+
+// evictionOrder returns all the transactions in the order CapWithScorer evicts
+// them: lowest score first, highest nonce first among equal scores.
+func (m *txSortedMap) evictionOrder(scorer EvictionScorer) []*types.Transaction {
+	type scored struct {
+		tx    *types.Transaction
+		score int64
+	}
+	candidates := make([]scored, 0, len(m.items))
+	for nonce, tx := range m.items {
+		candidates = append(candidates, scored{tx, scorer.Score(tx, m.meta(nonce))})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score < candidates[j].score
+		}
+		return candidates[i].tx.Nonce() > candidates[j].tx.Nonce()
+	})
+	order := make([]*types.Transaction, len(candidates))
+	for i, c := range candidates {
+		order[i] = c.tx
+	}
+	return order
+}
+
+// meta returns the metadata maintained for the transaction with the given nonce.
+func (m *txSortedMap) meta(nonce uint64) TxMeta {
+	return TxMeta{Arrival: m.arrivals[nonce], Priority: m.priorities[nonce]}
 }
 
 // Remove deletes a transaction from the maintained map, returning whether the transaction was found. If strict is true
@@ -186,7 +575,8 @@ func (m *txSortedMap) Remove(nonce uint64, strict bool, invalid func(*types.Tran
 		return false
 	}
 	m.ensureCache()
-	delete(m.items, nonce)
+	m.del(nonce)
+	m.gen++
 	i := sort.Search(len(m.cache), func(i int) bool {
 		return m.cache[i].Nonce() >= nonce
 	})
@@ -195,32 +585,81 @@ func (m *txSortedMap) Remove(nonce uint64, strict bool, invalid func(*types.Tran
 		// Repair the cache and heap.
 		copy(m.cache[i:], m.cache[i+1:])
 		m.cache = m.cache[:len(m.cache)-1]
-		for i := 0; i < m.index.Len(); i++ {
-			if (*m.index)[i] == nonce {
-				heap.Remove(m.index, i)
-				break
-			}
-		}
+		m.index.remove(nonce)
 		return true
 	}
 
 	// Remove invalidated.
 	for _, tx := range m.cache[i+1:] {
-		delete(m.items, tx.Nonce())
+		m.del(tx.Nonce())
 		invalid(tx)
 	}
 
 	// Repair the cache and heap.
 	m.cache = m.cache[:i]
-	*m.index = make([]uint64, 0, len(m.items))
-	for nonce := range m.items {
-		*m.index = append(*m.index, nonce)
-	}
-	heap.Init(m.index)
+	m.reheap()
 
 	return true
 }
 
+// DropReason describes why a transaction was removed from a txSortedMap.
+type DropReason uint8
+
+const (
+	DropForwarded   DropReason = iota // Nonce fell below the account nonce
+	DropCapped                        // Transaction exceeded the capacity of the map
+	DropFiltered                      // Transaction matched a removal filter
+	DropInvalidated                   // Transaction was invalidated by the removal of a lower nonce in strict mode
+)
+
+// ForwardWithReason is like Forward, but passes every removed transaction to a
+// single callback along with the reason of its removal.
+func (m *txSortedMap) ForwardWithReason(threshold uint64, dropped func(*types.Transaction, DropReason)) int {
+	return m.Forward(threshold, func(tx *types.Transaction) { dropped(tx, DropForwarded) })
+}
+
+// CapWithReason is like Cap, but passes every removed transaction to a single
+// callback along with the reason of its removal.
+func (m *txSortedMap) CapWithReason(threshold int, dropped func(*types.Transaction, DropReason)) int {
+	return m.Cap(threshold, func(tx *types.Transaction) { dropped(tx, DropCapped) })
+}
+
+// FilterWithReason is like Filter, but passes every removed transaction to a
+// single callback along with the reason of its removal.
+func (m *txSortedMap) FilterWithReason(filter func(*types.Transaction) bool, strict bool, dropped func(*types.Transaction, DropReason)) {
+	m.Filter(filter, strict,
+		func(tx *types.Transaction) { dropped(tx, DropFiltered) },
+		func(tx *types.Transaction) { dropped(tx, DropInvalidated) })
+}
+
+// RemoveWithReason is like Remove, but passes every transaction invalidated by
+// the removal to a single callback along with the reason of its removal.
+func (m *txSortedMap) RemoveWithReason(nonce uint64, strict bool, dropped func(*types.Transaction, DropReason)) bool {
+	return m.Remove(nonce, strict, func(tx *types.Transaction) { dropped(tx, DropInvalidated) })
+}
+
+// RemoveRange deletes all transactions with a nonce in [low, high], calling fn
+// with each in nonce order. The nonce index is rebuilt only once and the sorted
+// cache is kept in order.
+func (m *txSortedMap) RemoveRange(low, high uint64, fn func(*types.Transaction)) {
+	if low > high {
+		return
+	}
+	m.ensureCache()
+	i := sort.Search(len(m.cache), func(i int) bool { return m.cache[i].Nonce() >= low })
+	j := sort.Search(len(m.cache), func(i int) bool { return m.cache[i].Nonce() > high })
+	if i == j {
+		return
+	}
+	for _, tx := range m.cache[i:j] {
+		m.del(tx.Nonce())
+		fn(tx)
+	}
+	m.cache = append(m.cache[:i], m.cache[j:]...)
+	m.gen++
+	m.reheap()
+}
+
 // Ready iterates over a sequentially increasing list of transactions that are ready for processing, removing
 // and calling fn for each one.
 //
@@ -229,36 +668,81 @@ func (m *txSortedMap) Remove(nonce uint64, strict bool, invalid func(*types.Tran
 // happen but better to be self correcting than failing!
 func (m *txSortedMap) Ready(start uint64, fn func(*types.Transaction)) {
 	// Short circuit if no transactions are available
-	if m.index.Len() == 0 || (*m.index)[0] > start {
+	if m.index.Len() == 0 || m.index.Peek() > start {
 		return
 	}
+	m.gen++
 	if m.cache == nil {
-		for next := (*m.index)[0]; m.index.Len() > 0 && (*m.index)[0] == next; next++ {
+		for next := m.index.Peek(); m.index.Len() > 0 && m.index.Peek() == next; next++ {
 			heap.Pop(m.index)
 			item := m.items[next]
-			delete(m.items, next)
+			m.del(next)
 			fn(item)
 		}
 		return
 	}
 	next := m.cache[0].Nonce()
-	for i, item := range m.cache {
+	var ready int
+	for _, item := range m.cache {
 		nonce := item.Nonce()
 		if nonce != next {
-			// Update cache.
-			m.cache = m.cache[i:]
 			break
 		}
-		delete(m.items, nonce)
+		m.del(nonce)
 		fn(item)
 		next++
+		ready++
 	}
+	// Update cache, which may have been consumed entirely.
+	m.cache = m.cache[ready:]
+
 	// Rebuild heap.
-	*m.index = make([]uint64, 0, len(m.items))
-	for nonce := range m.items {
-		*m.index = append(*m.index, nonce)
+	m.reheap()
+}
+
+// ReadyFunc offers the sequentially increasing run of transactions that Ready
+// would remove to accept, one by one in nonce order. Iteration stops at the
+// first transaction accept returns false for, which is kept in the map along
+// with all the following ones. Only the accepted transactions are removed.
+func (m *txSortedMap) ReadyFunc(start uint64, accept func(*types.Transaction) bool) {
+	var last *types.Transaction
+	for _, tx := range m.readyRun(start) {
+		if !accept(tx) {
+			break
+		}
+		last = tx
 	}
-	heap.Init(m.index)
+	if last != nil {
+		m.Forward(last.Nonce()+1, func(*types.Transaction) {})
+	}
+}
+
+// EachGapped calls fn in nonce order with every transaction that is not part of
+// the sequentially increasing run Ready would remove for start, i.e. everything
+// past the first nonce gap. The map is not modified.
+func (m *txSortedMap) EachGapped(start uint64, fn func(*types.Transaction)) {
+	run := m.readyRun(start)
+	for _, tx := range m.cache[len(run):] {
+		fn(tx)
+	}
+}
+
+// readyRun returns the part of the sorted cache holding the sequentially increasing
+// run of transactions Ready would remove for start. The result must not be
+// modified or retained across mutations.
+func (m *txSortedMap) readyRun(start uint64) types.Transactions {
+	m.ensureCache()
+	if len(m.cache) == 0 || m.cache[0].Nonce() > start {
+		return nil
+	}
+	next := m.cache[0].Nonce()
+	for i, tx := range m.cache {
+		if tx.Nonce() != next {
+			return m.cache[:i]
+		}
+		next++
+	}
+	return m.cache
 }
 
 // Len returns the length of the transaction map.
@@ -266,6 +750,50 @@ func (m *txSortedMap) Len() int {
 	return len(m.items)
 }
 
+// txSortedMapShrinkWaste is the number of unused slots the backing arrays of a
+// txSortedMap must waste, beyond the slots in use, before Shrink reallocates
+// them. This keeps steady-state maps from being reallocated over and over.
+const txSortedMapShrinkWaste = 64
+
+// Shrink releases the excess capacity of the nonce heap and sorted cache after
+// large removals, reallocating them right-sized if they waste more than
+// txSortedMapShrinkWaste slots above their length.
+func (m *txSortedMap) Shrink() {
+	wasteful := func(length, capacity int) bool {
+		return capacity-2*length > txSortedMapShrinkWaste
+	}
+	if wasteful(m.index.Len(), cap(m.index.Values)) {
+		m.reheap()
+	}
+	if m.cache != nil && wasteful(len(m.cache), cap(m.cache)) {
+		cache := make(types.Transactions, len(m.cache))
+		copy(cache, m.cache)
+		m.cache = cache
+	}
+}
+
+// Nonces returns the sorted nonces of all the stored transactions. The nonce
+// index is copied and sorted, leaving the sorted cache untouched.
+func (m *txSortedMap) Nonces() []uint64 {
+	nonces := make([]uint64, len(m.index.Values))
+	copy(nonces, m.index.Values)
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+	return nonces
+}
+
+// CountBelow returns the number of transactions with a nonce lower than the
+// provided threshold, without removing any of them. The nonce index is scanned
+// so the sorted cache is neither built nor invalidated.
+func (m *txSortedMap) CountBelow(threshold uint64) int {
+	var count int
+	for _, nonce := range m.index.Values {
+		if nonce < threshold {
+			count++
+		}
+	}
+	return count
+}
+
 // Flatten creates a nonce-sorted slice of transactions based on the loosely
 // sorted internal representation. The result of the sorting is cached in case
 // it's requested again before any modifications are made to the contents.
@@ -277,6 +805,68 @@ func (m *txSortedMap) Flatten() types.Transactions {
 	return txs
 }
 
+// FlattenView is a non-copying version of Flatten, returning the internal sorted
+// cache directly. The caller must neither modify the returned slice nor retain
+// it past the next modification of the map.
+func (m *txSortedMap) FlattenView() types.Transactions {
+	m.ensureCache()
+	return m.cache
+}
+
+// Range calls fn with each transaction with a nonce in [start, end) in ascending
+// nonce order, stopping early if fn returns false. The map is not modified and
+// the sorted cache is reused (or built) for the walk.
+func (m *txSortedMap) Range(start, end uint64, fn func(*types.Transaction) bool) {
+	m.ensureCache()
+	cache := m.cache
+	i := sort.Search(len(cache), func(i int) bool {
+		return cache[i].Nonce() >= start
+	})
+	for ; i < len(cache) && cache[i].Nonce() < end; i++ {
+		if !fn(cache[i]) {
+			return
+		}
+	}
+}
+
+// EachIndexed calls fn with each transaction in ascending nonce order along with
+// its zero-based position, stopping early if fn returns false. The map is not
+// modified and the sorted cache is reused (or built) for the walk.
+func (m *txSortedMap) EachIndexed(fn func(i int, tx *types.Transaction) bool) {
+	m.ensureCache()
+	for i, tx := range m.cache {
+		if !fn(i, tx) {
+			return
+		}
+	}
+}
+
+// RevEach calls fn with each transaction in descending nonce order, stopping
+// early if fn returns false. The map is not modified and the sorted cache is
+// reused (or built) for the walk.
+func (m *txSortedMap) RevEach(fn func(*types.Transaction) bool) {
+	m.ensureCache()
+	for i := len(m.cache) - 1; i >= 0; i-- {
+		if !fn(m.cache[i]) {
+			return
+		}
+	}
+}
+
+// FirstAbove returns the transaction with the smallest nonce strictly greater
+// than the threshold, binary searching the sorted cache, along with whether
+// there is any.
+func (m *txSortedMap) FirstAbove(threshold uint64) (*types.Transaction, bool) {
+	m.ensureCache()
+	i := sort.Search(len(m.cache), func(i int) bool {
+		return m.cache[i].Nonce() > threshold
+	})
+	if i == len(m.cache) {
+		return nil, false
+	}
+	return m.cache[i], true
+}
+
 // ForLast calls fn with each of the last n txs in nonce order. The result of the sorting is cached in case
 // it's requested again before any modifications are made to the contents.
 func (m *txSortedMap) ForLast(n int, fn func(*types.Transaction)) {
@@ -285,18 +875,34 @@ func (m *txSortedMap) ForLast(n int, fn func(*types.Transaction)) {
 	if i < 0 {
 		i = 0
 	}
+	if i < len(m.cache) {
+		m.gen++
+	}
 	for _, tx := range m.cache[i:] {
-		delete(m.items, tx.Nonce())
+		m.del(tx.Nonce())
 		fn(tx)
 	}
 	m.cache = m.cache[:i]
 
 	// Rebuild heap.
-	*m.index = make([]uint64, 0, len(m.items))
-	for nonce := range m.items {
-		*m.index = append(*m.index, nonce)
+	m.reheap()
+}
+
+// LastN returns a copy of the last n txs in nonce order without removing them,
+// previewing what ForLast would visit. The result of the sorting is cached in
+// case it's requested again before any modifications are made to the contents.
+func (m *txSortedMap) LastN(n int) types.Transactions {
+	m.ensureCache()
+	i := len(m.cache) - n
+	if i < 0 {
+		i = 0
 	}
-	heap.Init(m.index)
+	if i > len(m.cache) {
+		i = len(m.cache)
+	}
+	txs := make(types.Transactions, len(m.cache)-i)
+	copy(txs, m.cache[i:])
+	return txs
 }
 
 // Last returns the highest nonce tx. The result of the sorting is cached in case
@@ -306,69 +912,694 @@ func (m *txSortedMap) Last() *types.Transaction {
 	return m.cache[len(m.cache)-1]
 }
 
+// MinNonce returns the lowest stored nonce and whether the map is non-empty. It
+// reads the root of the nonce heap, so neither the cache nor the transaction is
+// touched.
+func (m *txSortedMap) MinNonce() (uint64, bool) {
+	if m.index.Len() == 0 {
+		return 0, false
+	}
+	return m.index.Peek(), true
+}
+
+// MaxNonce returns the highest stored nonce and whether the map is non-empty,
+// without sorting. The sorted cache is used if available, otherwise all the stored
+// nonces are scanned. The items are scanned rather than the nonce heap, since
+// batch insertions via set only rebuild the heap after admitting the whole batch.
+func (m *txSortedMap) MaxNonce() (uint64, bool) {
+	if len(m.items) == 0 {
+		return 0, false
+	}
+	if cache := m.cached(); len(cache) > 0 {
+		return cache[len(cache)-1].Nonce(), true
+	}
+	var highest uint64
+	for nonce := range m.items {
+		if nonce > highest {
+			highest = nonce
+		}
+	}
+	return highest, true
+}
+
+// ensureCache creates the sorted cache if it's missing. Readers may call it
+// concurrently, as the creation is serialized, so read-only methods such as
+// Flatten, Last or Range are safe to use from multiple goroutines as long as no
+// goroutine modifies the map at the same time and no cache manager is attached.
+// Mutations still require external synchronization.
 func (m *txSortedMap) ensureCache() {
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+
 	// If the sorting was not cached yet, create and cache it
 	if m.cache == nil {
 		m.cache = make(types.Transactions, 0, len(m.items))
 		for _, tx := range m.items {
 			m.cache = append(m.cache, tx)
 		}
-		sort.Sort(types.TxByNonce(m.cache))
+		if m.countCmps {
+			sort.Sort(countingSort{Interface: types.TxByNonce(m.cache), cmps: &m.cmps})
+		} else {
+			sort.Sort(types.TxByNonce(m.cache))
+		}
+		sortedMapRebuildCounter.Inc(1)
+	}
+	if m.cacheMgr != nil {
+		m.cacheMgr.touch(m)
 	}
 }
 
+// cached returns the sorted cache without creating it, which may be nil. Unlike
+// reading the field directly, it is safe against a concurrent ensureCache.
+func (m *txSortedMap) cached() types.Transactions {
+	m.cacheMu.Lock()
+	defer m.cacheMu.Unlock()
+	return m.cache
+}
+
+// invariants checks the internal consistency of the map: every stored nonce has
+// to appear exactly once in the heap with a tracked position, the heap has to be
+// ordered and the cache, if present, has to hold exactly the stored transactions
+// in nonce order.
+func (m *txSortedMap) invariants() error {
+	if m.index.Len() != len(m.items) {
+		return fmt.Errorf("heap size mismatch: have %d, want %d", m.index.Len(), len(m.items))
+	}
+	if len(m.index.pos) != len(m.items) {
+		return fmt.Errorf("heap position count mismatch: have %d, want %d", len(m.index.pos), len(m.items))
+	}
+	if len(m.hashes) != len(m.items) {
+		return fmt.Errorf("hash index size mismatch: have %d, want %d", len(m.hashes), len(m.items))
+	}
+	for hash, nonce := range m.hashes {
+		if tx := m.items[nonce]; tx == nil || tx.Hash() != hash {
+			return fmt.Errorf("stale hash index entry: %x at nonce %d", hash, nonce)
+		}
+	}
+	seen := make(map[uint64]struct{}, m.index.Len())
+	for i, nonce := range m.index.Values {
+		if _, ok := m.items[nonce]; !ok {
+			return fmt.Errorf("dangling heap entry: nonce %d", nonce)
+		}
+		if _, ok := seen[nonce]; ok {
+			return fmt.Errorf("duplicate heap entry: nonce %d", nonce)
+		}
+		seen[nonce] = struct{}{}
+
+		if pos, ok := m.index.pos[nonce]; !ok || pos != i {
+			return fmt.Errorf("heap position mismatch: nonce %d at %d, tracked at %d", nonce, i, pos)
+		}
+		if i > 0 && m.index.Less(i, (i-1)/2) {
+			return fmt.Errorf("heap order violated: nonce %d below parent %d", nonce, m.index.Values[(i-1)/2])
+		}
+	}
+	if m.cache == nil {
+		return nil
+	}
+	if len(m.cache) != len(m.items) {
+		return fmt.Errorf("cache size mismatch: have %d, want %d", len(m.cache), len(m.items))
+	}
+	for i, tx := range m.cache {
+		if m.items[tx.Nonce()] != tx {
+			return fmt.Errorf("stale cache entry: nonce %d", tx.Nonce())
+		}
+		if i > 0 && m.cache[i-1].Nonce() >= tx.Nonce() {
+			return fmt.Errorf("cache order violated: nonce %d after %d", tx.Nonce(), m.cache[i-1].Nonce())
+		}
+	}
+	return nil
+}
+
+// CountComparisons enables or disables counting the comparisons made while
+// sorting the cache, a diagnostic for profiling sorts of huge accounts. It is
+// disabled by default.
+func (m *txSortedMap) CountComparisons(enabled bool) {
+	m.countCmps = enabled
+}
+
+// Comparisons returns the number of comparisons made while sorting the cache
+// since counting was enabled.
+func (m *txSortedMap) Comparisons() uint64 {
+	return m.cmps
+}
+
+// countingSort wraps a sort.Interface, counting the invocations of Less.
+type countingSort struct {
+	sort.Interface
+	cmps *uint64
+}
+
+func (s countingSort) Less(i, j int) bool {
+	*s.cmps++
+	return s.Interface.Less(i, j)
+}
+
+// TxMapDump is an exported wrapper of a txSortedMap for dumping its contents as
+// JSON, allowing a queue to be persisted for offline analysis and reloaded.
+type TxMapDump struct {
+	txs *txSortedMap
+}
+
+// MarshalJSON encodes the transactions of the map as a JSON object keyed by nonce.
+func (d *TxMapDump) MarshalJSON() ([]byte, error) {
+	if d.txs == nil {
+		return json.Marshal(map[uint64]*types.Transaction{})
+	}
+	return json.Marshal(d.txs.items)
+}
+
+// UnmarshalJSON replaces the wrapped map with one holding the decoded
+// transactions, with a freshly built heap and no cache.
+func (d *TxMapDump) UnmarshalJSON(data []byte) error {
+	var items map[uint64]*types.Transaction
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	txs := newTxSortedMapCap(len(items))
+	for nonce, tx := range items {
+		if tx == nil || tx.Nonce() != nonce {
+			return fmt.Errorf("transaction dumped under wrong nonce %d", nonce)
+		}
+		txs.set(tx)
+	}
+	txs.reheap()
+	txs.cache = nil
+
+	d.txs = txs
+	return nil
+}
+
+// txListHistoryLimit is the maximum number of accepted transactions remembered
+// per nonce when replacement history tracking is enabled.
+const txListHistoryLimit = 32
+
+// txReplacementBuckets are the exclusive upper bounds, in percent, of the gas price
+// premium buckets replacements are counted in. Premiums of at least the last bound
+// fall into an extra, unbounded bucket.
+var txReplacementBuckets = [...]uint64{10, 25, 50, 100}
+
+// txReplacement records a transaction accepted at a nonce of a txList.
+type txReplacement struct {
+	Hash  common.Hash     `json:"hash"`
+	To    *common.Address `json:"to"`    // Recipient of the transaction, nil for contract creations
+	Value *big.Int        `json:"value"` // Value transferred by the transaction
+}
+
+// sameIntent reports whether two recorded transactions transfer the same value to
+// the same recipient, i.e. differ at most in their fees.
+func (r txReplacement) sameIntent(other txReplacement) bool {
+	if (r.To == nil) != (other.To == nil) || (r.To != nil && *r.To != *other.To) {
+		return false
+	}
+	return r.Value.Cmp(other.Value) == 0
+}
+
+// AddReason describes the outcome of an attempt to insert a transaction into a
+// txList.
+type AddReason uint8
+
+const (
+	AddAccepted         AddReason = iota // Transaction was inserted, possibly replacing an older one
+	RejectedUnderpriced                  // Replacement did not clear the price bump of the existing transaction
+	RejectedFrozen                       // Replacement was attempted at a frozen nonce
+	RejectedGapTooLarge                  // Nonce is too far ahead of the stored transactions
+	RejectedWrongSender                  // Sender differs from the one the list holds transactions for
+	RejectedOverBudget                   // Transaction would push the total cost of the list over its budget
+	RejectedDuplicate                    // Identical transaction is already stored
+)
+
+// AddResult describes the outcome of an attempt to insert a transaction into a
+// txList.
+type AddResult struct {
+	Accepted bool               // Whether the transaction was inserted
+	Replaced *types.Transaction // Transaction replaced by the inserted one, if any
+	Reason   AddReason          // Reason of the outcome
+}
+
+// txAddOpts carries the caller supplied parameters consulted when admitting a
+// transaction into a txList.
+type txAddOpts struct {
+	priceBump    uint64   // Minimum price bump percentage required to replace a transaction
+	minBump      *big.Int // Minimum absolute price increase required to replace a transaction (nil = none)
+	currentBlock uint64   // Number of the current head block, used to thaw frozen nonces
+	base         *uint64  // Next nonce of the account, used to bound gaps in empty lists (nil = unknown)
+
+	sender *common.Address // Recovered sender of the transaction, if known
+}
+
+// TxMeta holds the metadata maintained alongside a transaction stored in a
+// transaction list, as passed to eviction scorers.
+type TxMeta struct {
+	Arrival  time.Time // Time the transaction was inserted at
+	Priority uint8     // Eviction priority of the transaction
+}
+
+// EvictionScorer ranks transactions for eviction when capping a list; the
+// transactions with the lowest scores are evicted first.
+type EvictionScorer interface {
+	Score(tx *types.Transaction, meta TxMeta) int64
+}
+
+// EvictionScorerFunc is an adapter to allow the use of ordinary functions as
+// eviction scorers.
+type EvictionScorerFunc func(tx *types.Transaction, meta TxMeta) int64
+
+// Score calls f(tx, meta).
+func (f EvictionScorerFunc) Score(tx *types.Transaction, meta TxMeta) int64 {
+	return f(tx, meta)
+}
+
+var (
+	// EvictByNonce evicts the highest nonce transactions first, like Cap.
+	EvictByNonce = EvictionScorerFunc(func(tx *types.Transaction, _ TxMeta) int64 {
+		return -int64(tx.Nonce())
+	})
+	// EvictByPrice evicts the lowest gas price transactions first.
+	EvictByPrice = EvictionScorerFunc(func(tx *types.Transaction, _ TxMeta) int64 {
+		if price := tx.GasPrice(); price.IsInt64() {
+			return price.Int64()
+		}
+		return math.MaxInt64
+	})
+	// EvictByAge evicts the oldest transactions first.
+	EvictByAge = EvictionScorerFunc(func(_ *types.Transaction, meta TxMeta) int64 {
+		return meta.Arrival.UnixNano()
+	})
+	// EvictBySize evicts the largest transactions first.
+	EvictBySize = EvictionScorerFunc(func(tx *types.Transaction, _ TxMeta) int64 {
+		return -int64(tx.Size())
+	})
+	// EvictByPriority evicts the lowest priority transactions first, highest
+	// nonce first among equals.
+	EvictByPriority = EvictionScorerFunc(func(_ *types.Transaction, meta TxMeta) int64 {
+		return int64(meta.Priority)
+	})
+)
+
+// ReplacementCandidate describes an attempt to replace the transaction stored at
+// a nonce of a txList with a new one.
+type ReplacementCandidate struct {
+	Old       *types.Transaction // Transaction currently stored at the nonce
+	New       *types.Transaction // Transaction attempting to replace it
+	PriceBump uint64             // Minimum price bump percentage requested by the caller
+	MinBump   *big.Int           // Minimum absolute price increase requested by the caller (nil = none)
+	OldOrigin *common.Address    // Origin of the stored transaction, if known
+	NewOrigin *common.Address    // Origin of the new transaction, if known
+}
+
+// ReplacementPolicy decides whether a transaction may replace the one stored at
+// the same nonce of a txList.
+type ReplacementPolicy interface {
+	Accept(c ReplacementCandidate) bool
+}
+
+var (
+	// DefaultReplacementPolicy accepts replacements whose gas price clears the
+	// price bump over the replaced transaction.
+	DefaultReplacementPolicy ReplacementPolicy = priceBumpPolicy{}
+
+	// KeepHigherGasOnTie accepts replacements like DefaultReplacementPolicy, but
+	// when neither transaction's gas price clears the bump over the other's, it
+	// keeps whichever has the higher gas limit.
+	KeepHigherGasOnTie ReplacementPolicy = higherGasOnTiePolicy{}
+)
+
+type priceBumpPolicy struct{}
+
+func (priceBumpPolicy) Accept(c ReplacementCandidate) bool {
+	return outbids(c.New, c.Old, c.PriceBump, c.MinBump)
+}
+
+type higherGasOnTiePolicy struct{}
+
+func (higherGasOnTiePolicy) Accept(c ReplacementCandidate) bool {
+	if outbids(c.New, c.Old, c.PriceBump, c.MinBump) {
+		return true
+	}
+	tie := !outbids(c.Old, c.New, c.PriceBump, c.MinBump)
+	return tie && c.New.Gas() > c.Old.Gas()
+}
+
+// OriginAwarePolicy accepts replacements like DefaultReplacementPolicy, but requires
+// a transaction from a different origin than the one it replaces to clear a
+// larger price bump, so third parties can't cheaply replace someone else's
+// transaction. The bump requested by the caller applies if either origin is
+// unknown.
+type OriginAwarePolicy struct {
+	CrossOriginBump uint64 // Minimum price bump percentage for cross origin replacements
+}
+
+// Accept implements ReplacementPolicy.
+func (p OriginAwarePolicy) Accept(c ReplacementCandidate) bool {
+	bump := c.PriceBump
+	if c.OldOrigin != nil && c.NewOrigin != nil && *c.OldOrigin != *c.NewOrigin && p.CrossOriginBump > bump {
+		bump = p.CrossOriginBump
+	}
+	return outbids(c.New, c.Old, bump, c.MinBump)
+}
+
+// outbids reports whether the gas price of tx clears the price bump percentage
+// over the gas price of old, as well as the absolute minBump if non-nil.
+func outbids(tx, old *types.Transaction, priceBump uint64, minBump *big.Int) bool {
+	threshold := new(big.Int).Div(new(big.Int).Mul(old.GasPrice(), big.NewInt(100+int64(priceBump))), big.NewInt(100))
+	// Have to ensure that the new gas price is higher than the old gas
+	// price as well as checking the percentage threshold to ensure that
+	// this is accurate for low (Wei-level) gas price replacements
+	if old.CmpGasPriceTx(tx) >= 0 || tx.CmpGasPrice(threshold) < 0 {
+		return false
+	}
+	// The percentage rounds down for tiny gas prices, so optionally enforce an
+	// absolute increase too
+	return minBump == nil || tx.CmpGasPrice(new(big.Int).Add(old.GasPrice(), minBump)) >= 0
+}
+
+// validateTxListSnapshots enables verifying the caps recorded in snapshots when
+// restoring a txList from them. It's meant for debugging and tests only, since
+// validation requires the full scan restoring from a snapshot aims to avoid.
+var validateTxListSnapshots = false
+
+// txListState is a point in time copy of the contents of a txList, including
+// its cost and gas caps so they need not be recomputed on an in-memory restore.
+// It is RLP encodable, allowing it to be persisted across restarts.
+type txListState struct {
+	Strict  bool
+	Txs     types.Transactions
+	CostCap *big.Int
+	GasCap  uint64
+}
+
+// validate checks that the recorded caps cover every transaction in the snapshot.
+func (s *txListState) validate() error {
+	for _, tx := range s.Txs {
+		if tx.Cost().Cmp(s.CostCap) > 0 {
+			return fmt.Errorf("tx %d cost %v exceeds snapshot cost cap %v", tx.Nonce(), tx.Cost(), s.CostCap)
+		}
+		if tx.Gas() > s.GasCap {
+			return fmt.Errorf("tx %d gas %d exceeds snapshot gas cap %d", tx.Nonce(), tx.Gas(), s.GasCap)
+		}
+	}
+	return nil
+}
+
 // txList is a "list" of transactions belonging to an account, sorted by account
 // nonce. The same type can be used both for storing contiguous transactions for
 // the executable/pending queue; and for storing gapped transactions for the non-
 // executable/future queue, with minor behavioral changes.
+//
+// Only Flatten, FlattenView, Last, Peek and Page may be called concurrently with
+// each other, and never with any modification of the list or while a cache
+// manager is attached. All other methods, including seemingly read-only ones such
+// as Fingerprint or the price ordered views, update internal caches and require
+// external synchronization.
 type txList struct {
-	strict bool         // Whether nonces are strictly continuous or not
-	txs    *txSortedMap // Heap indexed sorted hash map of the transactions
+	strict bool            // Whether nonces are strictly continuous or not
+	txs    *txSortedMap    // Heap indexed sorted hash map of the transactions
+	sender *common.Address // Sender all the transactions are expected from (nil = unchecked)
 
 	costcap *big.Int // Price of the highest costing transaction (reset only if exceeds balance)
 	gascap  uint64   // Gas limit of the highest spending transaction (reset only if exceeds block limit)
+
+	baseFee   *big.Int           // Base fee the effective gas prices are computed against
+	priced    types.Transactions // Cache of the transactions sorted by effective gas price
+	pricedGen uint64             // Generation of the transaction map the price cache was built at
+
+	history map[uint64][]txReplacement // Transactions accepted per nonce (nil unless tracking is enabled)
+	frozen  map[uint64]uint64          // Nonces rejecting replacements up to and including a block number
+	head    uint64                     // Latest head block number learned of, used to thaw frozen nonces
+
+	replacements uint64                                // Number of transactions replaced since the list was created
+	replaced     map[uint64]int                        // Number of replacements per stored nonce (nil until the first replacement)
+	premiums     [len(txReplacementBuckets) + 1]uint64 // Number of replacements per gas price premium bucket
+	maxNonceGap  uint64                                // Maximum distance of a new nonce past the highest stored one (0 = unlimited)
+	maxCost      *big.Int                              // Maximum total cost of the stored transactions (nil = unlimited)
+
+	onReplace func(old, tx *types.Transaction) // Optional callback fired whenever Add replaces a transaction
+	policy    ReplacementPolicy                // Policy deciding on same nonce replacements (nil = default)
+	weights   *StucknessWeights                // Weights of the stuckness score (nil = default)
+	inflight  map[uint64]struct{}              // Nonces handed out by ReadyTentative awaiting an ack or nack
+	origins   map[uint64]common.Address        // Senders of the stored transactions, where known
+
+	fingerprint    common.Hash // Cached hash of the nonce-sorted transaction hashes
+	fingerprintGen uint64      // Generation of the transaction map the fingerprint was computed at, plus one
+
+	// ProtectTopFee makes Cap and Filter spare the transaction with the highest
+	// gas price, so an aggressive replacement isn't dropped by a pool-wide trim.
+	ProtectTopFee bool
 }
 
 // newTxList create a new transaction list for maintaining nonce-indexable fast,
 // gapped, sortable transaction lists.
 func newTxList(strict bool) *txList {
-	return &txList{
+	return newTxListCap(strict, 0)
+}
+
+// newTxListCap creates a new transaction list like newTxList, with room for n
+// transactions.
+func newTxListCap(strict bool, n int) *txList {
+	l := &txList{
 		strict:  strict,
-		txs:     newTxSortedMap(),
+		txs:     newTxSortedMapCap(n),
 		costcap: new(big.Int),
 	}
+	l.txs.onDelete = l.forget
+	return l
+}
+
+// forget drops the metadata of a transaction which left the list, whichever way
+// it was removed, so a later transaction at the same nonce starts afresh.
+func (l *txList) forget(nonce uint64) {
+	delete(l.inflight, nonce)
+	delete(l.replaced, nonce)
+}
+
+// newTxListBounded creates a new transaction list like newTxList, which rejects
+// any transaction that would push the total cost of the list above maxCost.
+func newTxListBounded(strict bool, maxCost *big.Int) *txList {
+	l := newTxList(strict)
+	l.SetMaxCost(maxCost)
+	return l
+}
+
+// newTxListFromSnapshot recreates a transaction list from a snapshot, trusting the
+// recorded caps instead of recomputing them. The caps are only verified if
+// snapshot validation is enabled.
+func newTxListFromSnapshot(s txListState) (*txList, error) {
+	if validateTxListSnapshots {
+		if err := s.validate(); err != nil {
+			return nil, err
+		}
+	}
+	l := newTxList(s.Strict)
+	for _, tx := range s.Txs {
+		l.txs.Put(tx)
+	}
+	l.costcap, l.gascap = new(big.Int).Set(s.CostCap), s.GasCap
+	return l, nil
+}
+
+// Snapshot returns a copy of the contents and caps of the list from which an
+// equivalent list can be restored via newTxListFromSnapshot or RestoreTxList.
+func (l *txList) Snapshot() txListState {
+	return txListState{
+		Strict:  l.strict,
+		Txs:     l.Flatten(),
+		CostCap: new(big.Int).Set(l.costcap),
+		GasCap:  l.gascap,
+	}
+}
+
+// RestoreTxList recreates a transaction list from a possibly persisted state,
+// rebuilding the nonce index and recomputing the caps from the transactions
+// instead of trusting the recorded ones.
+func RestoreTxList(s txListState) *txList {
+	l := newTxListCap(s.Strict, len(s.Txs))
+	for _, tx := range s.Txs {
+		l.txs.set(tx)
+	}
+	l.txs.reheap()
+	l.Recompute()
+	return l
+}
+
+// newTxListForSender creates a new transaction list like newTxList, which rejects
+// any transaction added with a known sender different from the given one. This
+// guards against the pool misrouting transactions.
+func newTxListForSender(strict bool, sender common.Address) *txList {
+	l := newTxList(strict)
+	l.sender = &sender
+	return l
+}
+
+// newTxListWithClock creates a new transaction list like newTxList, timestamping
+// the transaction arrivals with the given clock.
+func newTxListWithClock(strict bool, clock txClock) *txList {
+	l := newTxList(strict)
+	l.txs.clock = clock
+	return l
+}
+
+// Peek returns the transaction with the lowest nonce without removing it, or nil
+// if the list is empty.
+func (l *txList) Peek() *types.Transaction {
+	return l.txs.Peek()
 }
 
 // Overlaps returns whether the transaction specified has the same nonce as one
 // already contained within the list.
 func (l *txList) Overlaps(tx *types.Transaction) bool {
-	return l.txs.Get(tx.Nonce()) != nil
+	return l.Has(tx.Nonce())
+}
+
+// GetByHash retrieves the transaction with the given hash from the list, or nil
+// if it is not stored.
+func (l *txList) GetByHash(hash common.Hash) *types.Transaction {
+	return l.txs.GetByHash(hash)
+}
+
+// Has returns whether the list contains a transaction with the given nonce.
+func (l *txList) Has(nonce uint64) bool {
+	return l.txs.Contains(nonce)
 }
 
 // Add tries to insert a new transaction into the list, returning whether the
 // transaction was accepted, and if yes, any previous transaction it replaced.
+// A replacement must raise the gas price by priceBump percent and, if minBump
+// is non-nil, by at least minBump wei.
 //
 // If the new transaction is accepted into the list, the lists' cost and gas
 // thresholds are also potentially updated.
-func (l *txList) Add(tx *types.Transaction, priceBump uint64) (bool, *types.Transaction) {
+//
+// Add doesn't take the head block, so frozen nonces are thawed against the latest
+// head the list learned of from AddWith or Thaw.
+func (l *txList) Add(tx *types.Transaction, priceBump uint64, minBump *big.Int) (bool, *types.Transaction) {
+	res := l.AddDetailed(tx, priceBump, minBump)
+	return res.Accepted, res.Replaced
+}
+
+// AddDetailed tries to insert a new transaction into the list like Add, but
+// reports the outcome along with its reason, e.g. to tell an underpriced
+// replacement apart from a duplicate.
+func (l *txList) AddDetailed(tx *types.Transaction, priceBump uint64, minBump *big.Int) AddResult {
+	inserted, old, reason := l.AddWith(tx, txAddOpts{priceBump: priceBump, minBump: minBump})
+	return AddResult{Accepted: inserted, Replaced: old, Reason: reason}
+}
+
+// WouldAccept reports whether Add would insert tx into the list given the same
+// priceBump and minBump, and which transaction it would replace, without
+// modifying the list. This allows a batch to be validated as a whole before any
+// of it gets committed.
+func (l *txList) WouldAccept(tx *types.Transaction, priceBump uint64, minBump *big.Int) (bool, *types.Transaction) {
+	old, reason := l.admit(tx, txAddOpts{priceBump: priceBump, minBump: minBump})
+	if reason != AddAccepted {
+		return false, nil
+	}
+	return true, old
+}
+
+// AddWith tries to insert a new transaction into the list like Add, but takes the
+// full set of admission parameters and additionally returns the reason of the
+// outcome.
+func (l *txList) AddWith(tx *types.Transaction, opts txAddOpts) (bool, *types.Transaction, AddReason) {
+	old, reason := l.admit(tx, opts)
+	if reason != AddAccepted {
+		return false, nil, reason
+	}
+	// Otherwise overwrite the old transaction with the current one
+	l.add(tx)
+	l.accepted(tx, old, opts)
+	return true, old, AddAccepted
+}
+
+// accepted updates the origin and replacement bookkeeping of the list after tx got
+// inserted, replacing old if non-nil.
+func (l *txList) accepted(tx *types.Transaction, old *types.Transaction, opts txAddOpts) {
+	if opts.sender != nil {
+		if l.origins == nil {
+			l.origins = make(map[uint64]common.Address)
+		}
+		l.origins[tx.Nonce()] = *opts.sender
+	} else {
+		delete(l.origins, tx.Nonce())
+	}
+	l.recordHistory(tx)
+	if old != nil {
+		l.replacements++
+		if l.replaced == nil {
+			l.replaced = make(map[uint64]int)
+		}
+		l.replaced[tx.Nonce()]++
+		l.premiums[replacementBucket(old, tx)]++
+		if l.onReplace != nil {
+			l.onReplace(old, tx)
+		}
+	}
+}
+
+// admit checks whether tx may be inserted into the list, returning the transaction
+// it would replace, if any.
+func (l *txList) admit(tx *types.Transaction, opts txAddOpts) (*types.Transaction, AddReason) {
+	if l.sender != nil && opts.sender != nil && *l.sender != *opts.sender {
+		return nil, RejectedWrongSender
+	}
+	// Track the head block, so callers not passing one still get freezes thawed
+	if opts.currentBlock > l.head {
+		l.head = opts.currentBlock
+	}
+	opts.currentBlock = l.head
+
 	// If there's an older better transaction, abort
 	old := l.txs.Get(tx.Nonce())
 	if old != nil {
-		threshold := new(big.Int).Div(new(big.Int).Mul(old.GasPrice(), big.NewInt(100+int64(priceBump))), big.NewInt(100))
-		// Have to ensure that the new gas price is higher than the old gas
-		// price as well as checking the percentage threshold to ensure that
-		// this is accurate for low (Wei-level) gas price replacements
-		if old.CmpGasPriceTx(tx) >= 0 || tx.CmpGasPrice(threshold) < 0 {
-			return false, nil
+		if old.Hash() == tx.Hash() {
+			return nil, RejectedDuplicate
+		}
+		if l.isFrozen(tx.Nonce(), opts.currentBlock) {
+			return nil, RejectedFrozen
+		}
+		policy := l.policy
+		if policy == nil {
+			policy = DefaultReplacementPolicy
+		}
+		candidate := ReplacementCandidate{Old: old, New: tx, PriceBump: opts.priceBump, MinBump: opts.minBump, NewOrigin: opts.sender}
+		if origin, ok := l.origins[tx.Nonce()]; ok {
+			candidate.OldOrigin = &origin
+		}
+		if !policy.Accept(candidate) {
+			return nil, RejectedUnderpriced
+		}
+	} else if l.maxNonceGap > 0 {
+		// Prevent reserving an enormous nonce range with a far-future transaction
+		// An empty list can only be bounded if the account nonce is known
+		highest, ok := l.txs.MaxNonce()
+		if !ok && opts.base != nil {
+			highest, ok = *opts.base, true
+		}
+		if nonce := tx.Nonce(); ok && nonce > highest && nonce-highest > l.maxNonceGap {
+			return nil, RejectedGapTooLarge
 		}
 	}
-	// Otherwise overwrite the old transaction with the current one
-	l.add(tx)
-	return true, old
+	if l.maxCost != nil && (old == nil || tx.Cost().Cmp(old.Cost()) > 0) {
+		// Refuse to grow the total cost past the budget, but allow replacements
+		// lowering it even if the budget is already exceeded
+		total := l.TotalCost()
+		total.Add(total, tx.Cost())
+		if old != nil {
+			total.Sub(total, old.Cost())
+		}
+		if total.Cmp(l.maxCost) > 0 {
+			return nil, RejectedOverBudget
+		}
+	}
+	return old, AddAccepted
 }
 
 func (l *txList) add(tx *types.Transaction) {
 	l.txs.Put(tx)
+	l.raiseCaps(tx)
+}
+
+// raiseCaps raises the cost and gas caps of the list to cover tx if needed.
+func (l *txList) raiseCaps(tx *types.Transaction) {
 	if cost := tx.Cost(); l.costcap.Cmp(cost) < 0 {
 		l.costcap = cost
 	}
@@ -379,15 +1610,110 @@ func (l *txList) add(tx *types.Transaction) {
 
 // Forward removes all transactions from the list with a nonce lower than the
 // provided threshold. Every removed transaction is passed to fn for any post-removal
-// maintenance.
-func (l *txList) Forward(threshold uint64, fn func(*types.Transaction)) {
-	l.txs.Forward(threshold, fn)
+// maintenance, and the number of removed transactions is returned.
+func (l *txList) Forward(threshold uint64, fn func(*types.Transaction)) int {
+	removed := l.txs.Forward(threshold, fn)
+	l.pruneBelow(threshold)
+	return removed
+}
+
+// ForwardApproved removes all transactions from the list with a nonce lower than
+// the provided threshold, except for those approve returns false for. This lets
+// the pool keep tracking transactions it still awaits confirmation for. Every
+// removed transaction is passed to fn for any post-removal maintenance.
+func (l *txList) ForwardApproved(threshold uint64, approve func(*types.Transaction) bool, fn func(*types.Transaction)) {
+	l.txs.ForwardApproved(threshold, approve, fn)
+	l.pruneBelow(threshold)
+}
+
+// ForwardAll forwards the list of every account present in nonces to the account's
+// new nonce, calling fn with each removed transaction and the account it belongs
+// to. The lists are forwarded concurrently, so they must not be shared between
+// accounts, but fn is only ever called from the calling goroutine, after all the
+// forwards are done.
+func ForwardAll(lists map[common.Address]*txList, nonces map[common.Address]uint64, fn func(common.Address, *types.Transaction)) {
+	type forward struct {
+		addr    common.Address
+		list    *txList
+		nonce   uint64
+		removed types.Transactions
+	}
+	work := make([]*forward, 0, len(nonces))
+	for addr, nonce := range nonces {
+		if list := lists[addr]; list != nil {
+			work = append(work, &forward{addr: addr, list: list, nonce: nonce})
+		}
+	}
+	run := func(f *forward) {
+		f.list.Forward(f.nonce, func(tx *types.Transaction) {
+			f.removed = append(f.removed, tx)
+		})
+	}
+	workers := runtime.NumCPU()
+	if workers > len(work) {
+		workers = len(work)
+	}
+	if workers <= 1 {
+		for _, f := range work {
+			run(f)
+		}
+	} else {
+		var (
+			wg    sync.WaitGroup
+			tasks = make(chan *forward, len(work))
+		)
+		for _, f := range work {
+			tasks <- f
+		}
+		close(tasks)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for f := range tasks {
+					run(f)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	for _, f := range work {
+		for _, tx := range f.removed {
+			fn(f.addr, tx)
+		}
+	}
+}
+
+// pruneBelow drops the per-nonce metadata of all the nonces lower than the
+// threshold which are no longer present in the list.
+func (l *txList) pruneBelow(threshold uint64) {
+	for nonce := range l.history {
+		if nonce < threshold && !l.txs.Contains(nonce) {
+			delete(l.history, nonce)
+		}
+	}
+	for nonce := range l.frozen {
+		if nonce < threshold && !l.txs.Contains(nonce) {
+			delete(l.frozen, nonce)
+		}
+	}
+	for nonce := range l.inflight {
+		if nonce < threshold && !l.txs.Contains(nonce) {
+			delete(l.inflight, nonce)
+		}
+	}
+	for nonce := range l.origins {
+		if nonce < threshold && !l.txs.Contains(nonce) {
+			delete(l.origins, nonce)
+		}
+	}
 }
 
 // Filter removes all transactions from the list with a cost or gas limit higher
 // than the provided thresholds. Every removed transaction is returned for any
 // post-removal maintenance. Strict-mode invalidated transactions are also
-// returned.
+// returned. If ProtectTopFee is set, the highest gas price transaction is spared,
+// though in strict mode it's still invalidated by the removal of a lower nonce.
 //
 // This method uses the cached costcap and gascap to quickly decide if there's even
 // a point in calculating all the costs or if the balance covers all. If the threshold
@@ -401,16 +1727,167 @@ func (l *txList) Filter(costLimit *big.Int, gasLimit uint64, removed, invalid fu
 	l.costcap = new(big.Int).Set(costLimit) // Lower the caps to the thresholds
 	l.gascap = gasLimit
 
+	var (
+		top    *types.Transaction
+		spared bool
+	)
+	if l.ProtectTopFee {
+		top = l.topFee()
+	}
+	filter := func(tx *types.Transaction) bool {
+		if tx.Cost().Cmp(costLimit) <= 0 && tx.Gas() <= gasLimit {
+			return false
+		}
+		if tx == top {
+			spared = true
+			return false
+		}
+		return true
+	}
+	l.txs.Filter(filter, l.strict, removed, invalid)
+
+	// A spared transaction exceeds the lowered caps, so they must be recomputed
+	// to still cover everything stored
+	if spared {
+		l.Recompute()
+	}
+}
+
+// FilterByGasPrice removes all transactions from the list with a gas price lower
+// than min. In strict mode, any transactions higher than the lowest nonce removed
+// are also invalidated and passed to invalid. If anything was removed, the cost
+// and gas caps are recomputed from the remaining transactions.
+func (l *txList) FilterByGasPrice(min *big.Int, removed, invalid func(*types.Transaction)) {
+	gen := l.txs.gen
 	filter := func(tx *types.Transaction) bool {
-		return tx.Cost().Cmp(costLimit) > 0 || tx.Gas() > gasLimit
+		return tx.CmpGasPrice(min) < 0
 	}
 	l.txs.Filter(filter, l.strict, removed, invalid)
+	if l.txs.gen != gen {
+		l.Recompute()
+	}
+}
+
+// Recompute sets the cost and gas caps to the exact maxima of the stored
+// transactions. The caps otherwise only ratchet up between filters, so stale
+// high caps defeat the short circuit of Filter.
+func (l *txList) Recompute() {
+	l.costcap, l.gascap = new(big.Int), 0
+	for _, tx := range l.txs.items {
+		l.raiseCaps(tx)
+	}
 }
 
 // Cap places a hard limit on the number of items, removing and calling removed with each transaction
-// exceeding that limit.
-func (l *txList) Cap(threshold int, removed func(*types.Transaction)) {
-	l.txs.Cap(threshold, removed)
+// exceeding that limit. The number of removed transactions is returned.
+//
+// Strict lists always drop their highest nonce tail, ignoring any priorities. If
+// ProtectTopFee is set, the transaction with the highest gas price is never
+// evicted. Strict lists can't have gaps punched into them, so they also keep all
+// the transactions below it, possibly staying above the threshold.
+func (l *txList) Cap(threshold int, removed func(*types.Transaction)) int {
+	if l.Len() <= threshold {
+		return 0
+	}
+	if !l.ProtectTopFee {
+		// Strict lists can't have gaps punched into them by priorities
+		if l.strict {
+			return l.txs.capTail(threshold, removed)
+		}
+		return l.txs.Cap(threshold, removed)
+	}
+	top := l.topFee()
+	if l.strict {
+		before := l.Len()
+		l.CapProtectingFront(threshold, l.txs.CountBelow(top.Nonce())+1, removed)
+		return before - l.Len()
+	}
+	drops := l.Len() - threshold
+	l.txs.CapWithScorer(threshold, protectingScorer(top), removed)
+	return drops
+}
+
+// protectingScorer returns a scorer evicting by priority that never picks top
+// before any other transaction.
+func protectingScorer(top *types.Transaction) EvictionScorer {
+	return EvictionScorerFunc(func(tx *types.Transaction, meta TxMeta) int64 {
+		if tx == top {
+			return math.MaxInt64
+		}
+		return int64(meta.Priority)
+	})
+}
+
+// topFee returns the transaction with the highest gas price, the lowest nonce one
+// among equals, or nil if the list is empty.
+func (l *txList) topFee() *types.Transaction {
+	var top *types.Transaction
+	for _, tx := range l.txs.FlattenView() {
+		if top == nil || tx.CmpGasPriceTx(top) > 0 {
+			top = tx
+		}
+	}
+	return top
+}
+
+// CapProtectingFront places a hard limit on the number of items like Cap, but
+// never evicts the protect lowest nonce transactions, regardless of priorities.
+// The highest nonce ones are dropped and passed to removed until the threshold is
+// met or only the protected ones remain, so no gap is opened at the front.
+func (l *txList) CapProtectingFront(threshold int, protect int, removed func(*types.Transaction)) {
+	if threshold < protect {
+		threshold = protect
+	}
+	if drops := l.Len() - threshold; drops > 0 {
+		l.txs.ForLast(drops, removed)
+	}
+}
+
+// CapDrop places a hard limit on the number of items like Cap, returning the
+// removed transactions in nonce order instead of passing them to a callback.
+func (l *txList) CapDrop(threshold int) types.Transactions {
+	var dropped types.Transactions
+	if n := l.Len() - threshold; n > 0 {
+		dropped = make(types.Transactions, 0, n)
+	}
+	l.Cap(threshold, func(tx *types.Transaction) {
+		dropped = append(dropped, tx)
+	})
+	// Cap evicts in priority and score order, not necessarily by nonce
+	sort.Sort(types.TxByNonce(dropped))
+	return dropped
+}
+
+// CapCost places a hard limit on the summed cost of the transactions, removing
+// the highest nonce ones and calling removed with each until the total does not
+// exceed the limit. If the lowest nonce transaction alone exceeds the limit, the
+// list is emptied. The caps are recomputed afterwards.
+func (l *txList) CapCost(limit *big.Int, removed func(*types.Transaction)) {
+	total := l.TotalCost()
+	if total.Cmp(limit) <= 0 {
+		return
+	}
+	cache := l.txs.FlattenView()
+
+	var drops int
+	for i := len(cache) - 1; i >= 0 && total.Cmp(limit) > 0; i-- {
+		total.Sub(total, cache[i].Cost())
+		drops++
+	}
+	l.txs.ForLast(drops, removed)
+	l.Recompute()
+}
+
+// CapWithScorer places a hard limit on the number of items, evicting the
+// transactions ranked lowest by scorer first and calling removed with each. Strict
+// lists can't have gaps punched into them, so they only ever drop their highest
+// nonce tail as Cap does, regardless of the scorer.
+func (l *txList) CapWithScorer(threshold int, scorer EvictionScorer, removed func(*types.Transaction)) {
+	if l.strict {
+		l.txs.capTail(threshold, removed)
+		return
+	}
+	l.txs.CapWithScorer(threshold, scorer, removed)
 }
 
 // Remove deletes a transaction from the maintained list, returning whether the
@@ -447,6 +1924,13 @@ func (l *txList) Flatten() types.Transactions {
 	return l.txs.Flatten()
 }
 
+// FlattenView is a non-copying version of Flatten for read-only callers. The
+// returned slice must not be modified or retained past the next modification of
+// the list.
+func (l *txList) FlattenView() types.Transactions {
+	return l.txs.FlattenView()
+}
+
 // ForLast calls fn with each of the last n txs in nonce order. The result of the sorting is cached in case
 // it's requested again before any modifications are made to the contents.
 func (l *txList) ForLast(n int, fn func(*types.Transaction)) {
@@ -458,3 +1942,1247 @@ func (l *txList) ForLast(n int, fn func(*types.Transaction)) {
 func (l *txList) Last() *types.Transaction {
 	return l.txs.Last()
 }
+
+// WeightedAvgGasPrice returns the gas weighted average of the effective gas prices
+// of the transactions in the list, i.e. sum(price*gas)/sum(gas). Nil is returned
+// if the list is empty or holds no gas at all.
+func (l *txList) WeightedAvgGasPrice(baseFee *big.Int) *big.Int {
+	var (
+		sum = new(big.Int)
+		gas = new(big.Int)
+	)
+	for _, tx := range l.txs.items {
+		limit := new(big.Int).SetUint64(tx.Gas())
+		gas.Add(gas, limit)
+		sum.Add(sum, limit.Mul(limit, effectiveGasPrice(tx, baseFee)))
+	}
+	if gas.Sign() == 0 {
+		return nil
+	}
+	return sum.Div(sum, gas)
+}
+
+// effectiveGasPrice returns the price per unit of gas paid by tx when included in
+// a block with the given base fee. All transactions on this chain are legacy
+// priced and pay their full gas price, so the base fee is currently unused.
+func effectiveGasPrice(tx *types.Transaction, baseFee *big.Int) *big.Int {
+	return tx.GasPrice()
+}
+
+// TopByPrice returns up to n transactions with the highest effective gas price,
+// ordered by descending price and ascending nonce for equal prices. The result
+// of the sorting is cached until the contents change or the list is repriced.
+func (l *txList) TopByPrice(n int) types.Transactions {
+	l.ensurePriceCache()
+	if n > len(l.priced) {
+		n = len(l.priced)
+	}
+	if n < 0 {
+		n = 0
+	}
+	txs := make(types.Transactions, n)
+	copy(txs, l.priced)
+	return txs
+}
+
+// FlattenByPrice returns a copy of all the transactions ordered by descending
+// effective gas price and ascending nonce for equal prices. The order does not
+// respect nonce sequencing, so it is only meant for pricing analysis and not for
+// executing the transactions. The result is cached alongside the nonce sorted
+// cache until the contents change or the list is repriced.
+func (l *txList) FlattenByPrice() types.Transactions {
+	return l.TopByPrice(len(l.txs.items))
+}
+
+// Reprice updates the base fee effective gas prices are computed against,
+// dropping any price based ordering computed with the previous one.
+func (l *txList) Reprice(baseFee *big.Int) {
+	l.baseFee = baseFee
+	l.InvalidatePriceCache()
+}
+
+// InvalidatePriceCache drops the cached price based ordering of the list, leaving
+// the nonce sorted cache intact. It is cheap enough to call on every base fee
+// update.
+func (l *txList) InvalidatePriceCache() {
+	l.priced = nil
+}
+
+// pricedAt returns the transactions sorted by their effective gas prices under
+// baseFee. The price cache is reused if it was built against the same base fee,
+// otherwise a one-off ordering is computed, leaving the base fee of the list and
+// its cache intact. The returned slice must not be modified.
+func (l *txList) pricedAt(baseFee *big.Int) types.Transactions {
+	if (l.baseFee == nil) != (baseFee == nil) || (baseFee != nil && l.baseFee.Cmp(baseFee) != 0) {
+		return l.sortByPrice(baseFee)
+	}
+	l.ensurePriceCache()
+	return l.priced
+}
+
+func (l *txList) ensurePriceCache() {
+	// If the price sorting was not cached yet or the contents changed, (re)create it
+	if l.priced != nil && l.pricedGen == l.txs.gen {
+		return
+	}
+	l.priced, l.pricedGen = l.sortByPrice(l.baseFee), l.txs.gen
+}
+
+// sortByPrice creates a slice of the transactions sorted by their effective gas
+// prices under baseFee.
+func (l *txList) sortByPrice(baseFee *big.Int) types.Transactions {
+	sorted := txsByPrice{
+		txs:    make(types.Transactions, 0, len(l.txs.items)),
+		prices: make([]*big.Int, 0, len(l.txs.items)),
+	}
+	for _, tx := range l.txs.items {
+		sorted.txs = append(sorted.txs, tx)
+		sorted.prices = append(sorted.prices, effectiveGasPrice(tx, baseFee))
+	}
+	sort.Sort(sorted)
+	return sorted.txs
+}
+
+// txsByPrice implements sort.Interface to order transactions by descending
+// effective gas price, breaking ties by ascending nonce.
+type txsByPrice struct {
+	txs    types.Transactions
+	prices []*big.Int
+}
+
+func (s txsByPrice) Len() int { return len(s.txs) }
+func (s txsByPrice) Less(i, j int) bool {
+	if c := s.prices[i].Cmp(s.prices[j]); c != 0 {
+		return c > 0
+	}
+	return s.txs[i].Nonce() < s.txs[j].Nonce()
+}
+func (s txsByPrice) Swap(i, j int) {
+	s.txs[i], s.txs[j] = s.txs[j], s.txs[i]
+	s.prices[i], s.prices[j] = s.prices[j], s.prices[i]
+}
+
+// TrackHistory enables recording the transactions accepted at each nonce. The
+// history of a nonce survives Remove, so re-submissions of previously dropped
+// transactions are visible, and is only pruned once the nonce is forwarded past.
+func (l *txList) TrackHistory() {
+	if l.history == nil {
+		l.history = make(map[uint64][]txReplacement)
+	}
+}
+
+// recordHistory appends tx to the history of its nonce if tracking is enabled,
+// discarding the oldest entries beyond txListHistoryLimit.
+func (l *txList) recordHistory(tx *types.Transaction) {
+	if l.history == nil {
+		return
+	}
+	nonce := tx.Nonce()
+	hist := append(l.history[nonce], txReplacement{Hash: tx.Hash(), To: tx.To(), Value: tx.Value()})
+	if len(hist) > txListHistoryLimit {
+		hist = hist[len(hist)-txListHistoryLimit:]
+	}
+	l.history[nonce] = hist
+}
+
+// DetectOscillation reports whether the transactions accepted at nonce keep
+// cycling between a small set of hashes, which is the case when the last window
+// accepted transactions hold at most window/2 distinct hashes. False is returned
+// if history tracking is disabled or fewer than window transactions were seen.
+func (l *txList) DetectOscillation(nonce uint64, window int) bool {
+	hist := l.history[nonce]
+	if window <= 1 || len(hist) < window {
+		return false
+	}
+	distinct := make(map[common.Hash]struct{}, window)
+	for _, entry := range hist[len(hist)-window:] {
+		distinct[entry.Hash] = struct{}{}
+	}
+	return 2*len(distinct) <= window
+}
+
+// Freeze rejects any replacement of the transaction at nonce until the head block
+// moves past untilBlock, throttling replacement wars without dropping the
+// currently stored transaction. Plain inserts at a free nonce are unaffected.
+func (l *txList) Freeze(nonce uint64, untilBlock uint64) {
+	if l.frozen == nil {
+		l.frozen = make(map[uint64]uint64)
+	}
+	l.frozen[nonce] = untilBlock
+}
+
+// Thaw lifts every freeze the head block at currentBlock has moved past, and
+// remembers the block for thawing the nonces replaced via Add later on.
+func (l *txList) Thaw(currentBlock uint64) {
+	if currentBlock > l.head {
+		l.head = currentBlock
+	}
+	for nonce := range l.frozen {
+		l.isFrozen(nonce, currentBlock)
+	}
+}
+
+// isFrozen reports whether replacements at nonce are rejected at currentBlock,
+// thawing the nonce once the block is past its freeze.
+func (l *txList) isFrozen(nonce uint64, currentBlock uint64) bool {
+	until, ok := l.frozen[nonce]
+	if !ok {
+		return false
+	}
+	if currentBlock > until {
+		delete(l.frozen, nonce)
+		return false
+	}
+	return true
+}
+
+// FlattenByArrival creates a slice of the transactions sorted by the time they
+// were inserted into the list, oldest first, breaking ties by nonce. Unlike
+// Flatten the result is not cached.
+func (l *txList) FlattenByArrival() types.Transactions {
+	txs := make(types.Transactions, 0, len(l.txs.items))
+	for _, tx := range l.txs.items {
+		txs = append(txs, tx)
+	}
+	arrivals := l.txs.arrivals
+	sort.Slice(txs, func(i, j int) bool {
+		ti, tj := arrivals[txs[i].Nonce()], arrivals[txs[j].Nonce()]
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return txs[i].Nonce() < txs[j].Nonce()
+	})
+	return txs
+}
+
+// FlattenTransform creates a nonce-sorted slice of the transactions passed through
+// fn, allowing callers to sanitize the output (e.g. redact calldata) without
+// altering the stored transactions. Transactions for which fn returns nil are
+// left out of the result. fn must return a new transaction rather than modify
+// the one it is given.
+func (l *txList) FlattenTransform(fn func(*types.Transaction) *types.Transaction) types.Transactions {
+	l.txs.ensureCache()
+	txs := make(types.Transactions, 0, len(l.txs.cache))
+	for _, tx := range l.txs.cache {
+		if tx = fn(tx); tx != nil {
+			txs = append(txs, tx)
+		}
+	}
+	return txs
+}
+
+// FilterAffordable walks the contiguous run of transactions starting at base,
+// accumulating their costs, and removes the first transaction pushing the total
+// over balance together with every higher nonce transaction, since executing
+// them in order would run out of funds. Every removed transaction is passed to
+// removed in nonce order once all of them are gone from the list. If anything was
+// removed, the cost and gas caps are recomputed from the remaining transactions.
+func (l *txList) FilterAffordable(balance *big.Int, base uint64, removed func(*types.Transaction)) {
+	l.txs.ensureCache()
+	cache := l.txs.cache
+	i := sort.Search(len(cache), func(i int) bool {
+		return cache[i].Nonce() >= base
+	})
+	spent := new(big.Int)
+	for next := base; i < len(cache) && cache[i].Nonce() == next; i, next = i+1, next+1 {
+		if spent.Add(spent, cache[i].Cost()).Cmp(balance) > 0 {
+			dropped := types.Transactions{cache[i]}
+			l.txs.Remove(cache[i].Nonce(), true, func(tx *types.Transaction) {
+				dropped = append(dropped, tx)
+			})
+			l.Recompute()
+			for _, tx := range dropped {
+				removed(tx)
+			}
+			return
+		}
+	}
+}
+
+// txListStats holds the raw counters and gauges describing one or more txLists.
+type txListStats struct {
+	Txs          uint64 // Number of transactions stored
+	Bytes        uint64 // Total encoded size of the stored transactions
+	Gas          uint64 // Total gas limit of the stored transactions
+	Calls        uint64 // Number of stored message calls
+	Creations    uint64 // Number of stored contract creations
+	Replacements uint64 // Number of transactions replaced since creation
+}
+
+// Stats returns the raw metrics of the list.
+func (l *txList) Stats() txListStats {
+	stats := txListStats{
+		Txs:          uint64(len(l.txs.items)),
+		Replacements: l.replacements,
+	}
+	for _, tx := range l.txs.items {
+		stats.Bytes += uint64(tx.Size())
+		stats.Gas += tx.Gas()
+		if tx.To() == nil {
+			stats.Creations++
+		} else {
+			stats.Calls++
+		}
+	}
+	return stats
+}
+
+// aggregateTxListStats sums up the raw metrics of all the given lists.
+func aggregateTxListStats(lists []*txList) txListStats {
+	var total txListStats
+	for _, list := range lists {
+		stats := list.Stats()
+		total.Txs += stats.Txs
+		total.Bytes += stats.Bytes
+		total.Gas += stats.Gas
+		total.Calls += stats.Calls
+		total.Creations += stats.Creations
+		total.Replacements += stats.Replacements
+	}
+	return total
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format,
+// prefixing every metric name with prefix.
+func (s txListStats) WritePrometheus(w io.Writer, prefix string) error {
+	metrics := []struct {
+		name, kind, labels string
+		value              uint64
+	}{
+		{"txs", "gauge", "", s.Txs},
+		{"bytes", "gauge", "", s.Bytes},
+		{"gas", "gauge", "", s.Gas},
+		{"txs_by_type", "gauge", `{type="call"}`, s.Calls},
+		{"txs_by_type", "gauge", `{type="create"}`, s.Creations},
+		{"replacements_total", "counter", "", s.Replacements},
+	}
+	var last string
+	for _, m := range metrics {
+		name := prefix + m.name
+		if name != last {
+			if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", name, m.kind); err != nil {
+				return err
+			}
+			last = name
+		}
+		if _, err := fmt.Fprintf(w, "%s%s %d\n", name, m.labels, m.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Generation returns a counter that changes every time the contents of the list
+// change, allowing callers to cheaply detect modifications between two points.
+func (l *txList) Generation() uint64 {
+	return l.txs.gen
+}
+
+// Fingerprint returns a Keccak256 hash over the nonce-sorted transaction hashes
+// of the list. Lists with identical contents have identical fingerprints. The
+// result is cached until the contents change.
+func (l *txList) Fingerprint() common.Hash {
+	if l.fingerprintGen == l.txs.gen+1 {
+		return l.fingerprint
+	}
+	l.txs.ensureCache()
+	hashes := make([][]byte, len(l.txs.cache))
+	for i, tx := range l.txs.cache {
+		hashes[i] = tx.Hash().Bytes()
+	}
+	l.fingerprint, l.fingerprintGen = crypto.Keccak256Hash(hashes...), l.txs.gen+1
+	return l.fingerprint
+}
+
+// TotalCost returns the summed cost of all the transactions in the list, as
+// opposed to costcap tracking only the highest one. The sum is maintained as
+// transactions are inserted and removed, so this is O(1).
+func (l *txList) TotalCost() *big.Int {
+	return new(big.Int).Set(l.txs.cost)
+}
+
+// TotalGas returns the summed gas limit of all the transactions in the list, as
+// opposed to gascap tracking only the highest one. The sum is maintained as
+// transactions are inserted and removed, so this is O(1).
+func (l *txList) TotalGas() uint64 {
+	return l.txs.gas
+}
+
+// SumCostUpTo returns the summed cost of the stored transactions with a nonce
+// lower than the given one, which have to be paid for before it.
+func (l *txList) SumCostUpTo(nonce uint64) *big.Int {
+	sum := new(big.Int)
+	l.txs.Range(0, nonce, func(tx *types.Transaction) bool {
+		sum.Add(sum, tx.Cost())
+		return true
+	})
+	return sum
+}
+
+// SetMaxCost adjusts the budget the total cost of the list may not be pushed
+// above by new transactions or replacements. Nil disables the limit. Already
+// stored transactions are kept even if they exceed a lowered budget.
+func (l *txList) SetMaxCost(maxCost *big.Int) {
+	if maxCost == nil {
+		l.maxCost = nil
+		return
+	}
+	l.maxCost = new(big.Int).Set(maxCost)
+}
+
+// ReplacementCount returns the number of times the transaction at the given
+// nonce has been replaced while stored in the list.
+func (l *txList) ReplacementCount(nonce uint64) int {
+	return l.replaced[nonce]
+}
+
+// SetMaxNonceGap limits how far past the highest stored nonce (or the account
+// nonce if the list is empty) new transactions may be inserted. Zero disables
+// the limit. Insertions into an empty list are only bounded if the account nonce
+// is supplied, as via AddWith, since Add doesn't know it.
+func (l *txList) SetMaxNonceGap(gap uint64) {
+	l.maxNonceGap = gap
+}
+
+// ReadyRLP removes the sequentially increasing run of transactions ready for
+// processing like Ready does, and returns them RLP encoded as a single list.
+//
+// Note, the list is mutated, so the caller must hold the pool lock as for Ready.
+func (l *txList) ReadyRLP(start uint64) ([]byte, error) {
+	var ready types.Transactions
+	l.Ready(start, func(tx *types.Transaction) {
+		ready = append(ready, tx)
+	})
+	return rlp.EncodeToBytes(ready)
+}
+
+// Executable returns the number of transactions Ready would remove for the given
+// start nonce, without removing anything.
+func (l *txList) Executable(start uint64) int {
+	return len(l.txs.readyRun(start))
+}
+
+// ReadyFunc offers the sequentially increasing run of transactions that Ready
+// would remove to accept, removing only the accepted ones. Iteration stops at
+// the first rejected transaction, which is kept along with all following ones.
+func (l *txList) ReadyFunc(start uint64, accept func(*types.Transaction) bool) {
+	l.txs.ReadyFunc(start, accept)
+}
+
+// PopReady removes and returns the sequentially increasing run of transactions
+// ready for processing like Ready does, in nonce order. If nothing is ready, an
+// empty slice is returned.
+func (l *txList) PopReady(start uint64) types.Transactions {
+	ready := make(types.Transactions, 0, len(l.txs.readyRun(start)))
+	l.Ready(start, func(tx *types.Transaction) {
+		ready = append(ready, tx)
+	})
+	return ready
+}
+
+// Partition moves the transactions of the list into two new lists: a strict one
+// holding the sequentially increasing run of executable transactions starting at
+// base and a non-strict one holding the gapped remainder. As with Ready, nonces
+// lower than base are treated as executable. Both lists inherit the configuration
+// of the original, and the arrival times and other per-nonce metadata follow
+// their transactions. The original list is left empty.
+func (l *txList) Partition(base uint64) (pending *txList, queued *txList) {
+	pending, queued = l.derive(true), l.derive(false)
+
+	l.txs.ensureCache()
+	next := base
+	if len(l.txs.cache) > 0 && l.txs.cache[0].Nonce() < next {
+		next = l.txs.cache[0].Nonce()
+	}
+	for _, tx := range l.txs.cache {
+		dst := queued
+		if tx.Nonce() == next {
+			dst = pending
+			next++
+		}
+		dst.add(tx)
+	}
+	// The pending run ends at next, so all metadata of lower nonces belongs to it
+	owner := func(nonce uint64) *txList {
+		if nonce < next {
+			return pending
+		}
+		return queued
+	}
+	for nonce, arrival := range l.txs.arrivals {
+		owner(nonce).txs.arrivals[nonce] = arrival
+	}
+	for nonce, priority := range l.txs.priorities {
+		dst := owner(nonce)
+		if dst.txs.priorities == nil {
+			dst.txs.priorities = make(map[uint64]uint8)
+		}
+		dst.txs.priorities[nonce] = priority
+	}
+	for nonce, hist := range l.history {
+		owner(nonce).history[nonce] = hist
+	}
+	for nonce, until := range l.frozen {
+		owner(nonce).Freeze(nonce, until)
+	}
+	for nonce, count := range l.replaced {
+		dst := owner(nonce)
+		if dst.replaced == nil {
+			dst.replaced = make(map[uint64]int)
+		}
+		dst.replaced[nonce] = count
+	}
+	for nonce := range l.inflight {
+		dst := owner(nonce)
+		if dst.inflight == nil {
+			dst.inflight = make(map[uint64]struct{})
+		}
+		dst.inflight[nonce] = struct{}{}
+	}
+	for nonce, origin := range l.origins {
+		dst := owner(nonce)
+		if dst.origins == nil {
+			dst.origins = make(map[uint64]common.Address)
+		}
+		dst.origins[nonce] = origin
+	}
+	l.txs.clear()
+	l.costcap, l.gascap = new(big.Int), 0
+	if l.history != nil {
+		l.history = make(map[uint64][]txReplacement)
+	}
+	l.frozen, l.origins = nil, nil
+
+	return pending, queued
+}
+
+// derive creates a new, empty list with the given strictness, carrying over the
+// configuration of l but none of its transactions or per-nonce metadata.
+func (l *txList) derive(strict bool) *txList {
+	d := newTxListWithClock(strict, l.txs.clock)
+	d.sender = l.sender
+	d.baseFee = l.baseFee
+	d.maxNonceGap = l.maxNonceGap
+	d.SetMaxCost(l.maxCost)
+	d.onReplace = l.onReplace
+	d.policy = l.policy
+	d.weights = l.weights
+	d.ProtectTopFee = l.ProtectTopFee
+	if l.history != nil {
+		d.TrackHistory()
+	}
+	if l.txs.cacheMgr != nil {
+		l.txs.cacheMgr.Register(d)
+	}
+	return d
+}
+
+// OnReplace sets a callback invoked with both the replaced and the replacing
+// transaction whenever Add replaces an existing transaction. Passing nil removes
+// the callback.
+func (l *txList) OnReplace(fn func(old, tx *types.Transaction)) {
+	l.onReplace = fn
+}
+
+// GasPricePercentiles returns the effective gas price at each of the requested
+// percentiles (in the range [0, 100]) of the transactions in the list, using the
+// nearest-rank method. The returned slice holds nils if the list is empty.
+func (l *txList) GasPricePercentiles(ps []float64, baseFee *big.Int) []*big.Int {
+	prices := make([]*big.Int, len(ps))
+	if l.Empty() {
+		return prices
+	}
+	priced := l.pricedAt(baseFee)
+
+	n := len(priced)
+	for i, p := range ps {
+		rank := int(math.Ceil(p / 100 * float64(n)))
+		if rank < 1 {
+			rank = 1
+		}
+		if rank > n {
+			rank = n
+		}
+		// The price cache is sorted by descending price
+		prices[i] = effectiveGasPrice(priced[n-rank], baseFee)
+	}
+	return prices
+}
+
+// GasPriceStats returns the lowest, median and highest gas price of the stored
+// transactions, reusing the price cache for ordering. The median of an even
+// number of transactions is the mean of the middle two. All are nil if the list
+// is empty.
+func (l *txList) GasPriceStats() (min, median, max *big.Int) {
+	if l.Empty() {
+		return nil, nil, nil
+	}
+	l.ensurePriceCache()
+
+	// The price cache is sorted by descending price
+	n := len(l.priced)
+	min, max = l.priced[n-1].GasPrice(), l.priced[0].GasPrice()
+	median = l.priced[n/2].GasPrice()
+	if n%2 == 0 {
+		median.Add(median, l.priced[n/2-1].GasPrice())
+		median.Rsh(median, 1)
+	}
+	return min, median, max
+}
+
+// ReadyTentative is the first phase of a two-phase Ready: it returns the
+// sequentially increasing run of transactions ready for processing from start
+// and marks them in-flight instead of removing them. In-flight transactions are
+// still part of the list but are not handed out again until they are either
+// acknowledged via AckReady or returned via NackReady.
+func (l *txList) ReadyTentative(start uint64) types.Transactions {
+	run := l.txs.readyRun(start)
+	if len(run) == 0 {
+		return nil
+	}
+	if l.inflight == nil {
+		l.inflight = make(map[uint64]struct{})
+	}
+	var ready types.Transactions
+	for _, tx := range run {
+		if _, ok := l.inflight[tx.Nonce()]; ok {
+			continue
+		}
+		l.inflight[tx.Nonce()] = struct{}{}
+		ready = append(ready, tx)
+	}
+	return ready
+}
+
+// AckReady completes a ReadyTentative for the given nonces, removing their
+// transactions from the list. Strict lists can't have gaps punched into them, so
+// they only remove acknowledged nonces forming a prefix of the list, leaving the
+// rest in-flight to be acknowledged after their predecessors or returned.
+func (l *txList) AckReady(nonces []uint64) {
+	sorted := make([]uint64, len(nonces))
+	copy(sorted, nonces)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	for _, nonce := range sorted {
+		if _, ok := l.inflight[nonce]; !ok {
+			continue
+		}
+		if lowest, _ := l.txs.MinNonce(); l.strict && nonce != lowest {
+			continue
+		}
+		l.txs.Remove(nonce, false, nil)
+	}
+}
+
+// NackReady aborts a ReadyTentative for the given nonces, making their
+// transactions available to be handed out again.
+func (l *txList) NackReady(nonces []uint64) {
+	for _, nonce := range nonces {
+		delete(l.inflight, nonce)
+	}
+}
+
+// ReplacementHistogram returns the number of replacements accepted since the list
+// was created, bucketed by the gas price premium paid over the replaced
+// transaction according to txReplacementBuckets.
+func (l *txList) ReplacementHistogram() []uint64 {
+	return append([]uint64(nil), l.premiums[:]...)
+}
+
+// replacementBucket returns the index of the premium bucket the replacement of
+// old by tx falls into.
+func replacementBucket(old, tx *types.Transaction) int {
+	oldPrice := old.GasPrice()
+	if oldPrice.Sign() == 0 {
+		return len(txReplacementBuckets)
+	}
+	premium := new(big.Int).Sub(tx.GasPrice(), oldPrice)
+	premium.Mul(premium, big.NewInt(100)).Div(premium, oldPrice)
+	for i, bound := range txReplacementBuckets {
+		if premium.Cmp(new(big.Int).SetUint64(bound)) < 0 {
+			return i
+		}
+	}
+	return len(txReplacementBuckets)
+}
+
+// ReadyGas returns the total gas limit of the sequentially increasing run of
+// transactions that Ready would remove for start, without removing anything.
+func (l *txList) ReadyGas(start uint64) uint64 {
+	var gas uint64
+	for _, tx := range l.txs.readyRun(start) {
+		gas += tx.Gas()
+	}
+	return gas
+}
+
+// FitsInGas reports whether the whole run of transactions ready for processing
+// from start fits into gasBudget, along with the total gas the run needs.
+func (l *txList) FitsInGas(start uint64, gasBudget uint64) (bool, uint64) {
+	gas := l.ReadyGas(start)
+	return gas <= gasBudget, gas
+}
+
+// StrandedNonces returns the nonces of the transactions which can no longer be
+// executed with the given balance: walking the transactions from base in nonce
+// order, the first one pushing the cumulative cost over the balance and every
+// one after it. Gaps only add to the funds needed, so they are walked over.
+func (l *txList) StrandedNonces(balance *big.Int, base uint64) []uint64 {
+	l.txs.ensureCache()
+	cache := l.txs.cache
+	i := sort.Search(len(cache), func(i int) bool {
+		return cache[i].Nonce() >= base
+	})
+	spent := new(big.Int)
+	for ; i < len(cache); i++ {
+		if spent.Add(spent, cache[i].Cost()).Cmp(balance) > 0 {
+			break
+		}
+	}
+	var stranded []uint64
+	for _, tx := range cache[i:] {
+		stranded = append(stranded, tx.Nonce())
+	}
+	return stranded
+}
+
+// QueuedValueBlocked estimates the total effective fee (price times gas limit) of
+// the transactions stuck behind the first nonce gap of the list, i.e. the queued
+// ones of WhatIf(base), matching what Stuckness considers queued.
+func (l *txList) QueuedValueBlocked(base uint64, baseFee *big.Int) *big.Int {
+	_, queued := l.WhatIf(base)
+	blocked := new(big.Int)
+	for _, tx := range queued {
+		fee := new(big.Int).SetUint64(tx.Gas())
+		blocked.Add(blocked, fee.Mul(fee, effectiveGasPrice(tx, baseFee)))
+	}
+	return blocked
+}
+
+// PruneOlderThan removes all transactions which arrived more than maxAge ago
+// according to the clock of the list, calling fn with each. In strict mode all
+// transactions with higher nonces than a pruned one are removed as well.
+func (l *txList) PruneOlderThan(maxAge time.Duration, fn func(*types.Transaction)) {
+	l.Prune(maxAge, l.txs.clock.Now(), fn)
+}
+
+// Prune removes all transactions inserted before now-maxAge regardless of their
+// nonce, calling fn with each. In strict mode all transactions with higher nonces
+// than a pruned one are removed as well. If anything was removed, the cost and
+// gas caps are recomputed from the remaining transactions.
+func (l *txList) Prune(maxAge time.Duration, now time.Time, fn func(*types.Transaction)) {
+	deadline := now.Add(-maxAge)
+	filter := func(tx *types.Transaction) bool {
+		return l.txs.arrivals[tx.Nonce()].Before(deadline)
+	}
+	gen := l.txs.gen
+	l.txs.Filter(filter, l.strict, fn, fn)
+	if l.txs.gen != gen {
+		l.Recompute()
+	}
+}
+
+// OldestSeen returns the earliest time any of the stored transactions was
+// inserted into the list at, or the zero time if the list is empty.
+func (l *txList) OldestSeen() time.Time {
+	var oldest time.Time
+	for _, arrival := range l.txs.arrivals {
+		if oldest.IsZero() || arrival.Before(oldest) {
+			oldest = arrival
+		}
+	}
+	return oldest
+}
+
+// Diff compares two snapshots of the same account's list by nonce and hash,
+// returning the transactions only present in new, the ones only present in old,
+// and the ones of new replacing a different transaction at the same nonce in old.
+// All three are in nonce order. A nil list is treated as empty.
+func Diff(old, new *txList) (added, removed, replaced types.Transactions) {
+	var oldTxs, newTxs types.Transactions
+	if old != nil {
+		oldTxs = old.FlattenView()
+	}
+	if new != nil {
+		newTxs = new.FlattenView()
+	}
+	// Both sides are nonce sorted, so walk them in lockstep
+	i, j := 0, 0
+	for i < len(oldTxs) || j < len(newTxs) {
+		switch {
+		case j == len(newTxs) || (i < len(oldTxs) && oldTxs[i].Nonce() < newTxs[j].Nonce()):
+			removed = append(removed, oldTxs[i])
+			i++
+		case i == len(oldTxs) || newTxs[j].Nonce() < oldTxs[i].Nonce():
+			added = append(added, newTxs[j])
+			j++
+		default:
+			if oldTxs[i].Hash() != newTxs[j].Hash() {
+				replaced = append(replaced, newTxs[j])
+			}
+			i++
+			j++
+		}
+	}
+	return added, removed, replaced
+}
+
+// MergeByPrice k-way merges the price sorted transactions of all the lists into a
+// single slice ordered by descending effective gas price under baseFee. Equally
+// priced transactions keep the order of their lists. Since nonce ordering is
+// ignored across lists, the result is meant for presentation and analysis only.
+func MergeByPrice(lists []*txList, baseFee *big.Int) types.Transactions {
+	var (
+		merged = make(priceMergeHeap, 0, len(lists))
+		total  int
+	)
+	for i, list := range lists {
+		priced := list.pricedAt(baseFee)
+		if len(priced) == 0 {
+			continue
+		}
+		total += len(priced)
+		merged = append(merged, &priceMergeCursor{
+			list:  i,
+			txs:   priced,
+			price: effectiveGasPrice(priced[0], baseFee),
+		})
+	}
+	heap.Init(&merged)
+
+	txs := make(types.Transactions, 0, total)
+	for len(merged) > 0 {
+		cursor := merged[0]
+		txs = append(txs, cursor.txs[0])
+		if cursor.txs = cursor.txs[1:]; len(cursor.txs) == 0 {
+			heap.Pop(&merged)
+			continue
+		}
+		cursor.price = effectiveGasPrice(cursor.txs[0], baseFee)
+		heap.Fix(&merged, 0)
+	}
+	return txs
+}
+
+// priceMergeCursor tracks the position of a MergeByPrice merge within the price
+// sorted transactions of a single list.
+type priceMergeCursor struct {
+	list  int                // Index of the list the cursor walks
+	txs   types.Transactions // Remaining transactions of the list
+	price *big.Int           // Effective gas price of the next transaction
+}
+
+// priceMergeHeap is a heap.Interface implementation over merge cursors, ordered
+// by descending price of their next transaction.
+type priceMergeHeap []*priceMergeCursor
+
+func (h priceMergeHeap) Len() int { return len(h) }
+func (h priceMergeHeap) Less(i, j int) bool {
+	if c := h[i].price.Cmp(h[j].price); c != 0 {
+		return c > 0
+	}
+	return h[i].list < h[j].list
+}
+func (h priceMergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *priceMergeHeap) Push(x interface{}) {
+	*h = append(*h, x.(*priceMergeCursor))
+}
+
+func (h *priceMergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+// SetReplacementPolicy sets the policy deciding whether a transaction may replace
+// the one stored at the same nonce. Nil restores DefaultReplacementPolicy.
+func (l *txList) SetReplacementPolicy(policy ReplacementPolicy) {
+	l.policy = policy
+}
+
+// BlockFillRatio returns the fraction of a block with the given gas limit that the
+// run of transactions ready for processing from start would consume, clamped to
+// 1 if the run exceeds the limit.
+func (l *txList) BlockFillRatio(start uint64, blockGasLimit uint64) float64 {
+	gas := l.ReadyGas(start)
+	if gas >= blockGasLimit {
+		return 1
+	}
+	return float64(gas) / float64(blockGasLimit)
+}
+
+// MarshalHistory encodes the replacement history of the list so it can be
+// persisted across restarts alongside the transaction journal.
+func (l *txList) MarshalHistory() ([]byte, error) {
+	return json.Marshal(l.history)
+}
+
+// UnmarshalHistory restores a replacement history encoded by MarshalHistory,
+// enabling history tracking. The history of nonces below base, which have been
+// forwarded past since the history was persisted, is discarded, as are empty
+// histories, and longer histories than txListHistoryLimit keep their newest
+// entries only. Entries without a value are rejected, leaving the list untouched.
+func (l *txList) UnmarshalHistory(data []byte, base uint64) error {
+	var history map[uint64][]txReplacement
+	if err := json.Unmarshal(data, &history); err != nil {
+		return err
+	}
+	for nonce, hist := range history {
+		for i, entry := range hist {
+			if entry.Value == nil {
+				return fmt.Errorf("missing value in history entry %d of nonce %d", i, nonce)
+			}
+		}
+	}
+	l.TrackHistory()
+	for nonce, hist := range history {
+		if nonce < base || len(hist) == 0 {
+			continue
+		}
+		if len(hist) > txListHistoryLimit {
+			hist = hist[len(hist)-txListHistoryLimit:]
+		}
+		l.history[nonce] = hist
+	}
+	return nil
+}
+
+// AddBatch inserts many transactions into the list, applying the same replacement
+// rules per nonce as Add, but only rebuilding the nonce index once at the end. It
+// returns the number of accepted transactions and the transactions they replaced.
+func (l *txList) AddBatch(txs types.Transactions, priceBump uint64) (int, types.Transactions) {
+	accepted, _, replaced := l.addBatch(txs, txAddOpts{priceBump: priceBump})
+	return len(accepted), replaced
+}
+
+// Merge moves every transaction of other into the list, applying the same
+// replacement rules on nonce conflicts as Add, and drains other. Arrival times
+// are preserved. The displaced transactions, both the replaced ones and the ones
+// of other failing to replace, are returned as they are in neither list anymore.
+// Merging a list into itself is a no-op.
+func (l *txList) Merge(other *txList, priceBump uint64) types.Transactions {
+	if other == l {
+		return nil
+	}
+	accepted, rejected, replaced := l.addBatch(other.txs.Flatten(), txAddOpts{priceBump: priceBump})
+	for _, tx := range accepted {
+		l.txs.arrivals[tx.Nonce()] = other.txs.arrivals[tx.Nonce()]
+	}
+	other.txs.clear()
+	other.costcap, other.gascap = new(big.Int), 0
+
+	return append(replaced, rejected...)
+}
+
+// addBatch inserts all the transactions into the list with the same admission
+// rules as AddWith, but only rebuilds the nonce heap once at the end. It returns
+// the accepted and rejected transactions along with any replaced ones.
+func (l *txList) addBatch(txs types.Transactions, opts txAddOpts) (accepted, rejected, replaced types.Transactions) {
+	for _, tx := range txs {
+		old, reason := l.admit(tx, opts)
+		if reason != AddAccepted {
+			rejected = append(rejected, tx)
+			continue
+		}
+		l.txs.set(tx)
+		l.raiseCaps(tx)
+		l.accepted(tx, old, opts)
+
+		accepted = append(accepted, tx)
+		if old != nil {
+			replaced = append(replaced, old)
+		}
+	}
+	if len(accepted) > 0 {
+		l.txs.reheap()
+	}
+	return accepted, rejected, replaced
+}
+
+// ApplyReorg performs the maintenance of the list after a chain reorganisation in
+// one go: all transactions below newBase are forwarded past, calling forwarded
+// with each, after which the reinjected transactions are added with the usual
+// replacement rules, rebuilding the nonce index only once. Reinjected transactions
+// below newBase are stale and get rejected.
+func (l *txList) ApplyReorg(newBase uint64, reinject types.Transactions, priceBump uint64, forwarded func(*types.Transaction)) (accepted, rejected types.Transactions) {
+	l.Forward(newBase, forwarded)
+
+	fresh := make(types.Transactions, 0, len(reinject))
+	for _, tx := range reinject {
+		if tx.Nonce() < newBase {
+			rejected = append(rejected, tx)
+			continue
+		}
+		fresh = append(fresh, tx)
+	}
+	accepted, stale, _ := l.addBatch(fresh, txAddOpts{priceBump: priceBump, base: &newBase})
+	return accepted, append(rejected, stale...)
+}
+
+// WhatIf splits the transactions of the list into pending and queued ones as if
+// base were the next nonce of the account, without modifying the list. Pending
+// holds the sequentially increasing run starting at base, queued all the higher
+// nonce transactions after it. Transactions below base are left out since they
+// would be stale.
+func (l *txList) WhatIf(base uint64) (pending, queued types.Transactions) {
+	l.txs.ensureCache()
+	cache := l.txs.cache
+	i := sort.Search(len(cache), func(i int) bool {
+		return cache[i].Nonce() >= base
+	})
+	j, next := i, base
+	for j < len(cache) && cache[j].Nonce() == next {
+		j, next = j+1, next+1
+	}
+	pending = make(types.Transactions, j-i)
+	copy(pending, cache[i:j])
+	queued = make(types.Transactions, len(cache)-j)
+	copy(queued, cache[j:])
+	return pending, queued
+}
+
+// ConflictingNonces returns the sorted nonces whose history holds transactions
+// with differing recipients or values, indicating that the sender submitted
+// conflicting intents rather than plain fee bumps. History tracking must be
+// enabled for any conflict to be detected.
+func (l *txList) ConflictingNonces() []uint64 {
+	var conflicts []uint64
+	for nonce, hist := range l.history {
+		if len(hist) < 2 {
+			continue
+		}
+		for _, entry := range hist[1:] {
+			if !entry.sameIntent(hist[0]) {
+				conflicts = append(conflicts, nonce)
+				break
+			}
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i] < conflicts[j]
+	})
+	return conflicts
+}
+
+// CapBytesSaved returns the total size of the transactions a Cap with the given
+// threshold would drop, without dropping anything. The selection matches Cap
+// exactly, including priorities and ProtectTopFee.
+func (l *txList) CapBytesSaved(threshold int) uint64 {
+	drops := l.Len() - threshold
+	if drops <= 0 {
+		return 0
+	}
+	var victims []*types.Transaction
+	switch {
+	case l.ProtectTopFee && l.strict:
+		// Mirror CapProtectingFront: only the tail above the top fee one goes
+		if protect := l.txs.CountBelow(l.topFee().Nonce()) + 1; l.Len()-protect < drops {
+			drops = l.Len() - protect
+		}
+		victims = l.txs.FlattenView()[l.Len()-drops:]
+	case l.ProtectTopFee:
+		victims = l.txs.evictionOrder(protectingScorer(l.topFee()))[:drops]
+	case !l.strict && len(l.txs.priorities) > 0:
+		victims = l.txs.evictionOrder(EvictByPriority)[:drops]
+	default:
+		victims = l.txs.FlattenView()[l.Len()-drops:]
+	}
+	var size uint64
+	for _, tx := range victims {
+		size += uint64(tx.Size())
+	}
+	return size
+}
+
+// Page returns a copy of the nonce-sorted transactions in positions
+// [offset, offset+limit), allowing large lists to be served in pages. Out of range
+// offsets yield an empty result.
+func (l *txList) Page(offset, limit int) types.Transactions {
+	l.txs.ensureCache()
+	if offset < 0 || limit <= 0 || offset >= len(l.txs.cache) {
+		return types.Transactions{}
+	}
+	end := len(l.txs.cache)
+	if limit < end-offset {
+		end = offset + limit
+	}
+	txs := make(types.Transactions, end-offset)
+	copy(txs, l.txs.cache[offset:end])
+	return txs
+}
+
+// BaseFeeDelta returns the transactions whose executability changes when the base
+// fee moves from oldFee to newFee. A transaction is executable if it's part of
+// the sequentially increasing run starting at base and neither it nor any lower
+// nonce transaction of the run has a fee cap below the base fee.
+func (l *txList) BaseFeeDelta(oldFee, newFee *big.Int, base uint64) (newlyStuck, newlyFreed types.Transactions) {
+	pending, _ := l.WhatIf(base)
+
+	executable := func(baseFee *big.Int) int {
+		for i, tx := range pending {
+			if baseFee != nil && gasFeeCap(tx).Cmp(baseFee) < 0 {
+				return i
+			}
+		}
+		return len(pending)
+	}
+	before, after := executable(oldFee), executable(newFee)
+	if after < before {
+		return pending[after:before], nil
+	}
+	return nil, pending[before:after]
+}
+
+// gasFeeCap returns the maximum price per unit of gas tx is willing to pay. All
+// transactions on this chain are legacy priced, so it equals their gas price.
+func gasFeeCap(tx *types.Transaction) *big.Int {
+	return tx.GasPrice()
+}
+
+// StucknessWeights tunes the components of the stuckness score of a txList. All
+// fields are optional: a zero weight disables its component, while a zero (or
+// nil) scale makes its component jump straight to 1 once anything is queued.
+type StucknessWeights struct {
+	Gaps  float64 // Weight of the nonce gap component
+	Age   float64 // Weight of the queued age component
+	Value float64 // Weight of the blocked value component
+
+	AgeScale   time.Duration // Queued age at which the age component reaches 0.5
+	ValueScale *big.Int      // Blocked value at which the value component reaches 0.5
+}
+
+// DefaultStucknessWeights weighs all components of the stuckness score equally.
+var DefaultStucknessWeights = StucknessWeights{
+	Gaps:       1,
+	Age:        1,
+	Value:      1,
+	AgeScale:   10 * time.Minute,
+	ValueScale: big.NewInt(1e18),
+}
+
+// SetStucknessWeights sets the weights of the stuckness score of the list. Nil
+// restores DefaultStucknessWeights.
+func (l *txList) SetStucknessWeights(weights *StucknessWeights) {
+	l.weights = weights
+}
+
+// Stuckness summarizes how stuck the account is as a score between 0 (healthy)
+// and 1 (hopelessly stuck), for surfacing problematic accounts. With the queued
+// transactions being those not executable from base, the score is the weighted
+// average of three components, each saturating towards 1:
+//
+//	gaps:  g/(g+1) for g missing nonce ranges between base and the highest nonce
+//	age:   a/(a+AgeScale) for the age a of the oldest queued transaction
+//	value: v/(v+ValueScale) for the effective fee v of the queued transactions
+func (l *txList) Stuckness(base uint64, baseFee *big.Int) float64 {
+	weights := l.weights
+	if weights == nil {
+		weights = &DefaultStucknessWeights
+	}
+	total := weights.Gaps + weights.Age + weights.Value
+	if total <= 0 {
+		return 0
+	}
+	_, queued := l.WhatIf(base)
+
+	var gaps int
+	next := base
+	for _, tx := range queued {
+		if tx.Nonce() > next {
+			gaps++
+		}
+		next = tx.Nonce() + 1
+	}
+	var (
+		now   = l.txs.clock.Now()
+		age   time.Duration
+		value = new(big.Int)
+	)
+	for _, tx := range queued {
+		if queuedFor := now.Sub(l.txs.arrivals[tx.Nonce()]); queuedFor > age {
+			age = queuedFor
+		}
+		fee := new(big.Int).SetUint64(tx.Gas())
+		value.Add(value, fee.Mul(fee, effectiveGasPrice(tx, baseFee)))
+	}
+	saturate := func(x, scale float64) float64 {
+		if x <= 0 {
+			return 0
+		}
+		return x / (x + scale)
+	}
+	valueF, _ := new(big.Float).SetInt(value).Float64()
+	var scaleF float64
+	if weights.ValueScale != nil {
+		scaleF, _ = new(big.Float).SetInt(weights.ValueScale).Float64()
+	}
+
+	score := weights.Gaps*saturate(float64(gaps), 1) +
+		weights.Age*saturate(float64(age), float64(weights.AgeScale)) +
+		weights.Value*saturate(valueF, scaleF)
+	return score / total
+}
+
+// GapFrom returns the first nonce at or above start which is missing from the
+// list while higher nonces are present, along with true. If the transactions from
+// start on are contiguous (or there are none), the nonce following the run is
+// returned along with false.
+func (l *txList) GapFrom(start uint64) (uint64, bool) {
+	next, gapped := start, false
+	l.txs.Range(start, math.MaxUint64, func(tx *types.Transaction) bool {
+		if tx.Nonce() != next {
+			gapped = true
+			return false
+		}
+		next++
+		return true
+	})
+	return next, gapped
+}
+
+// Gaps returns the inclusive ranges of nonces missing from the list between start
+// and its highest nonce, in ascending order, e.g. [[7, 8]] for nonces {5, 6, 9, 10}
+// and start 5. A nil result means the transactions from start on are contiguous.
+func (l *txList) Gaps(start uint64) [][2]uint64 {
+	var gaps [][2]uint64
+	next := start
+	l.txs.Range(start, math.MaxUint64, func(tx *types.Transaction) bool {
+		if nonce := tx.Nonce(); nonce != next {
+			gaps = append(gaps, [2]uint64{next, nonce - 1})
+		}
+		next = tx.Nonce() + 1
+		return true
+	})
+	return gaps
+}
+
+// SetStrict switches the list between strict and non-strict mode in place. When
+// switching to strict mode, every transaction past the first nonce gap from base
+// is removed, since a strict list must be contiguous, and the removed ones are
+// returned in nonce order.
+func (l *txList) SetStrict(strict bool, base uint64) types.Transactions {
+	var dropped types.Transactions
+	if strict && !l.strict {
+		l.TruncateAtGap(base, func(tx *types.Transaction) {
+			dropped = append(dropped, tx)
+		})
+	}
+	l.strict = strict
+	return dropped
+}
+
+// TruncateAtGap removes every transaction above the first nonce missing from
+// start on, calling fn with each of them in nonce order, and leaves the contiguous
+// prefix intact. It is a no-op if there is no gap.
+func (l *txList) TruncateAtGap(start uint64, fn func(*types.Transaction)) {
+	gap, gapped := l.GapFrom(start)
+	if !gapped {
+		return
+	}
+	// Everything past the gap is removed in order, so the strict walk is used
+	// regardless of the list's mode
+	l.txs.Filter(func(tx *types.Transaction) bool { return tx.Nonce() > gap }, true, fn, fn)
+}
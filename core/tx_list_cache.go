@@ -0,0 +1,106 @@
+// Copyright 2026 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"container/list"
+	"unsafe"
+
+	"github.com/gochain/gochain/v4/core/types"
+)
+
+// txCacheEntrySize is the memory held by a single entry of a sorted cache.
+const txCacheEntrySize = uint64(unsafe.Sizeof((*types.Transaction)(nil)))
+
+// txCacheManager bounds the total memory held by the sorted caches of the lists
+// registered with it. Whenever the total exceeds the limit, the caches of the
+// least recently used lists are dropped until it fits again.
+//
+// The sizes are recorded when a list uses its cache, so mutations in between
+// are only accounted for at the next use. The manager is not safe for concurrent
+// use and must be guarded by the same lock as the lists registered with it.
+type txCacheManager struct {
+	limit uint64                         // Maximum number of bytes held by the caches
+	used  uint64                         // Number of bytes held by the caches at their last use
+	lru   *list.List                     // Registered maps, most recently used first
+	elems map[*txSortedMap]*list.Element // Position of each registered map in the lru
+}
+
+// txCacheEntry is an lru element of a txCacheManager.
+type txCacheEntry struct {
+	m    *txSortedMap
+	size uint64
+}
+
+// newTxCacheManager creates a cache manager holding at most limit bytes of
+// sorted caches.
+func newTxCacheManager(limit uint64) *txCacheManager {
+	return &txCacheManager{
+		limit: limit,
+		lru:   list.New(),
+		elems: make(map[*txSortedMap]*list.Element),
+	}
+}
+
+// Register puts the sorted cache of the list under the control of the manager.
+func (c *txCacheManager) Register(l *txList) {
+	l.txs.cacheMgr = c
+}
+
+// Unregister releases the list from the manager, e.g. when it's discarded.
+func (c *txCacheManager) Unregister(l *txList) {
+	if elem, ok := c.elems[l.txs]; ok {
+		c.used -= elem.Value.(*txCacheEntry).size
+		c.lru.Remove(elem)
+		delete(c.elems, l.txs)
+	}
+	l.txs.cacheMgr = nil
+}
+
+// Used returns the number of bytes held by the managed caches at their last use.
+func (c *txCacheManager) Used() uint64 {
+	return c.used
+}
+
+// touch marks the cache of m as the most recently used one and updates its size,
+// evicting the caches of the least recently used maps if over the limit.
+func (c *txCacheManager) touch(m *txSortedMap) {
+	size := uint64(cap(m.cache)) * txCacheEntrySize
+
+	elem, ok := c.elems[m]
+	if !ok {
+		elem = c.lru.PushFront(&txCacheEntry{m: m})
+		c.elems[m] = elem
+	} else {
+		c.lru.MoveToFront(elem)
+	}
+	entry := elem.Value.(*txCacheEntry)
+	c.used += size - entry.size
+	entry.size = size
+
+	for c.used > c.limit {
+		last := c.lru.Back()
+		if last == elem {
+			break
+		}
+		evicted := last.Value.(*txCacheEntry)
+		evicted.m.cache = nil
+		c.used -= evicted.size
+		c.lru.Remove(last)
+		delete(c.elems, evicted.m)
+	}
+}
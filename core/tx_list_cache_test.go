@@ -0,0 +1,65 @@
+// Copyright 2026 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/gochain/gochain/v4/crypto"
+)
+
+// Tests that the cache manager drops the cache of the least recently flattened
+// list once the budget is exceeded.
+func TestTxCacheManager(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	manager := newTxCacheManager(20 * txCacheEntrySize)
+
+	lists := make([]*txList, 3)
+	for i := range lists {
+		lists[i] = newTxList(false)
+		for nonce := uint64(0); nonce < 10; nonce++ {
+			lists[i].Add(transaction(nonce, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+		}
+		manager.Register(lists[i])
+	}
+	lists[0].Flatten()
+	lists[1].Flatten()
+	if lists[0].txs.cache == nil || lists[1].txs.cache == nil {
+		t.Fatalf("expected caches within the budget to be kept")
+	}
+	if used := manager.Used(); used != 20*txCacheEntrySize {
+		t.Fatalf("expected %d bytes used but got %d", 20*txCacheEntrySize, used)
+	}
+
+	// Touch the first list again, so the second one is the least recently used.
+	lists[0].Flatten()
+	lists[2].Flatten()
+	if lists[1].txs.cache != nil {
+		t.Errorf("expected the least recently used cache to be evicted")
+	}
+	if lists[0].txs.cache == nil || lists[2].txs.cache == nil {
+		t.Errorf("expected the recently used caches to be kept")
+	}
+	if used := manager.Used(); used != 20*txCacheEntrySize {
+		t.Errorf("expected %d bytes used but got %d", 20*txCacheEntrySize, used)
+	}
+
+	manager.Unregister(lists[0])
+	if used := manager.Used(); used != 10*txCacheEntrySize {
+		t.Errorf("expected %d bytes used after unregistering but got %d", 10*txCacheEntrySize, used)
+	}
+}
@@ -17,11 +17,23 @@
 package core
 
 import (
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"math/big"
 	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gochain/gochain/v4/common"
 	"github.com/gochain/gochain/v4/core/types"
 	"github.com/gochain/gochain/v4/crypto"
+	"github.com/gochain/gochain/v4/rlp"
 )
 
 // Tests that transactions can be added to strict lists and list contents and
@@ -37,7 +49,7 @@ func TestStrictTxListAdd(t *testing.T) {
 	// Insert the transactions in a random order
 	list := newTxList(true)
 	for _, v := range rand.Perm(len(txs)) {
-		list.Add(txs[v], DefaultTxPoolConfig.PriceBump)
+		list.Add(txs[v], DefaultTxPoolConfig.PriceBump, nil)
 	}
 	// Verify internal state
 	if len(list.txs.items) != len(txs) {
@@ -61,36 +73,592 @@ func TestTxSortedMap_Cap(t *testing.T) {
 	}
 
 	var removed int
-	txSortedMap.Cap(500, func(*types.Transaction) {
+	count := txSortedMap.Cap(500, func(*types.Transaction) {
 		removed++
 	})
-	if removed != 524 {
-		t.Fatalf("expected to remove 524 but got %d", removed)
+	if removed != 524 || count != 524 {
+		t.Fatalf("expected to remove 524 but got %d (reported %d)", removed, count)
 	}
 
 	removed = 0
-	txSortedMap.Cap(1, func(*types.Transaction) {
+	count = txSortedMap.Cap(1, func(*types.Transaction) {
 		removed++
 	})
-	if removed != 499 {
-		t.Fatalf("expected to remove 499 but got %d", removed)
+	if removed != 499 || count != 499 {
+		t.Fatalf("expected to remove 499 but got %d (reported %d)", removed, count)
 	}
 
 	txSortedMap.cache = nil
 
 	removed = 0
-	txSortedMap.Cap(0, func(*types.Transaction) {
+	count = txSortedMap.Cap(0, func(*types.Transaction) {
 		removed++
 	})
-	if removed != 1 {
-		t.Errorf("expected to remove 1 but got %d", removed)
+	if removed != 1 || count != 1 {
+		t.Errorf("expected to remove 1 but got %d (reported %d)", removed, count)
 	}
 
-	if len(txSortedMap.items) > 0 || len(txSortedMap.cache) > 0 || len(*txSortedMap.index) > 0 {
+	if len(txSortedMap.items) > 0 || len(txSortedMap.cache) > 0 || txSortedMap.index.Len() > 0 {
 		t.Fatalf("expected empty txSortedMap but got %#v", txSortedMap)
 	}
 }
 
+func TestTxSortedMap_CapPriority(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	key, _ := crypto.GenerateKey()
+	for i := 0; i < 10; i++ {
+		switch i {
+		case 8:
+			txSortedMap.PutPriority(transaction(uint64(i), 0, key), 2)
+		case 9, 3:
+			txSortedMap.PutPriority(transaction(uint64(i), 0, key), 1)
+		default:
+			txSortedMap.Put(transaction(uint64(i), 0, key))
+		}
+	}
+	var removed []uint64
+	if n := txSortedMap.Cap(4, func(tx *types.Transaction) { removed = append(removed, tx.Nonce()) }); n != 6 {
+		t.Fatalf("expected 6 evictions, have %d", n)
+	}
+	want := []uint64{7, 6, 5, 4, 2, 1}
+	for i := range want {
+		if removed[i] != want[i] {
+			t.Fatalf("expected evictions %v, have %v", want, removed)
+		}
+	}
+	if err := txSortedMap.invariants(); err != nil {
+		t.Fatalf("inconsistent map: %v", err)
+	}
+	// Overwriting a prioritized transaction resets its priority
+	txSortedMap.Put(pricedTransaction(8, 0, big.NewInt(2), key))
+	txSortedMap.Cap(3, func(tx *types.Transaction) { removed = append(removed, tx.Nonce()) })
+	if last := removed[len(removed)-1]; last != 8 {
+		t.Errorf("expected the overwritten nonce 8 to be evicted, have %d", last)
+	}
+}
+
+func TestTxSortedMap_Peek(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	if tx := txSortedMap.Peek(); tx != nil {
+		t.Fatalf("expected nil for an empty map but got %v", tx)
+	}
+
+	key, _ := crypto.GenerateKey()
+	for _, i := range rand.Perm(10) {
+		txSortedMap.Put(transaction(uint64(i+5), 0, key))
+	}
+	if tx := txSortedMap.Peek(); tx == nil || tx.Nonce() != 5 {
+		t.Fatalf("expected nonce 5 from the heap but got %v", tx)
+	}
+	txSortedMap.ensureCache()
+	if tx := txSortedMap.Peek(); tx == nil || tx.Nonce() != 5 {
+		t.Fatalf("expected nonce 5 from the cache but got %v", tx)
+	}
+	if txSortedMap.Len() != 10 {
+		t.Errorf("expected nothing to be removed, have %d txs", txSortedMap.Len())
+	}
+}
+
+func TestTxSortedMap_CountBelow(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	if n := txSortedMap.CountBelow(10); n != 0 {
+		t.Fatalf("expected 0 for an empty map but got %d", n)
+	}
+
+	key, _ := crypto.GenerateKey()
+	for _, i := range rand.Perm(10) {
+		txSortedMap.Put(transaction(uint64(i+5), 0, key))
+	}
+	for threshold, want := range map[uint64]int{0: 0, 5: 0, 6: 1, 10: 5, 15: 10, 100: 10} {
+		if n := txSortedMap.CountBelow(threshold); n != want {
+			t.Errorf("threshold %d: expected %d txs but got %d", threshold, want, n)
+		}
+	}
+	if txSortedMap.cache != nil {
+		t.Errorf("expected the cache to be left untouched")
+	}
+	if txSortedMap.Len() != 10 {
+		t.Errorf("expected nothing to be removed, have %d txs", txSortedMap.Len())
+	}
+}
+
+func TestTxSortedMap_Nonces(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	if nonces := txSortedMap.Nonces(); len(nonces) != 0 {
+		t.Fatalf("expected no nonces for an empty map but got %v", nonces)
+	}
+	key, _ := crypto.GenerateKey()
+	for _, i := range rand.Perm(10) {
+		txSortedMap.Put(transaction(uint64(2*i), 0, key))
+	}
+	nonces := txSortedMap.Nonces()
+	if len(nonces) != 10 {
+		t.Fatalf("expected 10 nonces but got %d", len(nonces))
+	}
+	for i, nonce := range nonces {
+		if nonce != uint64(2*i) {
+			t.Errorf("nonce %d: expected %d but got %d", i, 2*i, nonce)
+		}
+	}
+	if err := txSortedMap.invariants(); err != nil {
+		t.Errorf("inconsistent map: %v", err)
+	}
+}
+
+func TestTxSortedMap_FlattenView(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	if txs := txSortedMap.FlattenView(); len(txs) != 0 {
+		t.Fatalf("expected no txs for an empty map but got %d", len(txs))
+	}
+
+	key, _ := crypto.GenerateKey()
+	for _, i := range rand.Perm(10) {
+		txSortedMap.Put(transaction(uint64(i), 0, key))
+	}
+	view := txSortedMap.FlattenView()
+	for i, tx := range view {
+		if tx.Nonce() != uint64(i) {
+			t.Fatalf("tx %d: expected nonce %d but got %d", i, i, tx.Nonce())
+		}
+	}
+	if &view[0] != &txSortedMap.cache[0] {
+		t.Errorf("expected the view to share the cache")
+	}
+	if flat := txSortedMap.Flatten(); &flat[0] == &view[0] {
+		t.Errorf("expected Flatten to copy the cache")
+	}
+}
+
+func TestTxSortedMap_Clone(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	key, _ := crypto.GenerateKey()
+	for _, i := range rand.Perm(10) {
+		txSortedMap.Put(transaction(uint64(i), 0, key))
+	}
+	txSortedMap.ensureCache()
+
+	clone := txSortedMap.Clone()
+	txSortedMap.Forward(5, func(*types.Transaction) {})
+	txSortedMap.Put(transaction(20, 0, key))
+
+	if clone.Len() != 10 || clone.index.Len() != 10 || len(clone.cache) != 10 {
+		t.Fatalf("expected the clone to be unaffected, have %d txs, %d index entries and %d cached", clone.Len(), clone.index.Len(), len(clone.cache))
+	}
+	for i, tx := range clone.Flatten() {
+		if tx.Nonce() != uint64(i) {
+			t.Fatalf("tx %d: expected nonce %d but got %d", i, i, tx.Nonce())
+		}
+	}
+	clone.Forward(3, func(*types.Transaction) {})
+	if tx := txSortedMap.Peek(); tx == nil || tx.Nonce() != 5 {
+		t.Errorf("expected the original to be unaffected by the clone, have lowest %v", tx)
+	}
+	if txSortedMap.Len() != 6 {
+		t.Errorf("expected 6 txs in the original, have %d", txSortedMap.Len())
+	}
+}
+
+func TestTxSortedMap_Remove(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	key, _ := crypto.GenerateKey()
+	for _, i := range rand.Perm(100) {
+		txSortedMap.Put(transaction(uint64(i), 0, key))
+	}
+	for _, i := range rand.Perm(100)[:50] {
+		if !txSortedMap.Remove(uint64(i), false, nil) {
+			t.Fatalf("failed to remove nonce %d", i)
+		}
+		if txSortedMap.Remove(uint64(i), false, nil) {
+			t.Fatalf("removed nonce %d twice", i)
+		}
+	}
+	if txSortedMap.index.Len() != 50 || len(txSortedMap.index.pos) != 50 {
+		t.Fatalf("expected 50 index entries, have %d heap and %d positions", txSortedMap.index.Len(), len(txSortedMap.index.pos))
+	}
+	for nonce, i := range txSortedMap.index.pos {
+		if txSortedMap.index.Values[i] != nonce {
+			t.Fatalf("nonce %d: position %d holds %d", nonce, i, txSortedMap.index.Values[i])
+		}
+	}
+	var prev *types.Transaction
+	txSortedMap.Forward(100, func(tx *types.Transaction) {
+		if prev != nil && tx.Nonce() <= prev.Nonce() {
+			t.Fatalf("nonces popped out of order: %d after %d", tx.Nonce(), prev.Nonce())
+		}
+		prev = tx
+	})
+	if len(txSortedMap.index.pos) != 0 {
+		t.Errorf("expected no positions left, have %d", len(txSortedMap.index.pos))
+	}
+}
+
+func TestTxSortedMap_PutAppendsCache(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	key, _ := crypto.GenerateKey()
+	for i := 0; i < 5; i++ {
+		txSortedMap.Put(transaction(uint64(i), 0, key))
+	}
+	txSortedMap.ensureCache()
+
+	// Appending higher nonces keeps the cache
+	txSortedMap.Put(transaction(5, 0, key))
+	txSortedMap.Put(transaction(7, 0, key))
+	if len(txSortedMap.cache) != 7 || txSortedMap.cache[6].Nonce() != 7 {
+		t.Fatalf("expected the cache to be extended to 7 txs, have %d", len(txSortedMap.cache))
+	}
+	// Overwriting or inserting below the highest nonce drops it
+	txSortedMap.Put(pricedTransaction(7, 0, big.NewInt(2), key))
+	if txSortedMap.cache != nil {
+		t.Fatalf("expected an overwrite to drop the cache")
+	}
+	txSortedMap.ensureCache()
+	txSortedMap.Put(transaction(6, 0, key))
+	if txSortedMap.cache != nil {
+		t.Fatalf("expected a lower nonce insert to drop the cache")
+	}
+	for i, tx := range txSortedMap.Flatten() {
+		if tx.Nonce() != uint64(i) {
+			t.Fatalf("tx %d: expected nonce %d but got %d", i, i, tx.Nonce())
+		}
+	}
+	if tx := txSortedMap.Last(); tx.GasPrice().Int64() != 2 {
+		t.Errorf("expected the overwriting tx last, have price %v", tx.GasPrice())
+	}
+}
+
+func TestTxSortedMap_Equal(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	first, second := newTxSortedMap(), newTxSortedMap()
+	for _, i := range rand.Perm(10) {
+		first.Put(transaction(uint64(i), 0, key))
+	}
+	for i := 9; i >= 0; i-- {
+		second.Put(first.Get(uint64(i)))
+	}
+	first.ensureCache()
+	if !first.Equal(second) || !second.Equal(first) {
+		t.Fatalf("expected maps with identical contents to be equal")
+	}
+	second.Put(pricedTransaction(3, 0, big.NewInt(2), key))
+	if first.Equal(second) {
+		t.Fatalf("expected a replacement to break equality")
+	}
+	second.Put(first.Get(3))
+	second.Remove(9, false, nil)
+	if first.Equal(second) || second.Equal(first) {
+		t.Errorf("expected a removal to break equality")
+	}
+}
+
+// Tests that random sequences of operations keep the map internally consistent.
+func TestTxSortedMap_Invariants(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	txs := make(types.Transactions, 64)
+	for i := range txs {
+		txs[i] = transaction(uint64(i), 0, key)
+	}
+	txSortedMap := newTxSortedMap()
+	for i := 0; i < 2000; i++ {
+		nonce := uint64(rand.Intn(len(txs)))
+		op := rand.Intn(8)
+		switch op {
+		case 0, 1, 2:
+			txSortedMap.Put(txs[nonce])
+		case 3:
+			txSortedMap.Remove(nonce, rand.Intn(2) == 0, func(*types.Transaction) {})
+		case 4:
+			txSortedMap.Forward(nonce/4, func(*types.Transaction) {})
+		case 5:
+			txSortedMap.Cap(rand.Intn(len(txs)), func(*types.Transaction) {})
+		case 6:
+			txSortedMap.Ready(nonce, func(*types.Transaction) {})
+		case 7:
+			txSortedMap.Filter(func(tx *types.Transaction) bool { return tx.Nonce()%7 == nonce%7 }, rand.Intn(2) == 0,
+				func(*types.Transaction) {}, func(*types.Transaction) {})
+		}
+		if rand.Intn(2) == 0 {
+			txSortedMap.ensureCache()
+		}
+		if err := txSortedMap.invariants(); err != nil {
+			t.Fatalf("operation %d (%d): %v", i, op, err)
+		}
+	}
+}
+
+func TestTxMapDump(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	key, _ := crypto.GenerateKey()
+	for _, i := range []uint64{7, 1, 3, 2} {
+		txSortedMap.Put(pricedTransaction(i, 100, big.NewInt(int64(i)), key))
+	}
+	txSortedMap.ensureCache()
+
+	data, err := json.Marshal(&TxMapDump{txs: txSortedMap})
+	if err != nil {
+		t.Fatalf("failed to marshal map: %v", err)
+	}
+	var dump TxMapDump
+	if err := json.Unmarshal(data, &dump); err != nil {
+		t.Fatalf("failed to unmarshal map: %v", err)
+	}
+	if !dump.txs.Equal(txSortedMap) {
+		t.Fatalf("expected the reloaded map to equal the dumped one")
+	}
+	if dump.txs.cache != nil {
+		t.Errorf("expected the reloaded map to have no cache")
+	}
+	if err := dump.txs.invariants(); err != nil {
+		t.Errorf("inconsistent reloaded map: %v", err)
+	}
+	if err := json.Unmarshal(bytes.Replace(data, []byte(`"7"`), []byte(`"8"`), 1), &dump); err == nil {
+		t.Errorf("expected a transaction under the wrong nonce to be rejected")
+	}
+}
+
+func TestNonceHeapDuplicatePush(t *testing.T) {
+	if !txListDebug {
+		t.Skip("duplicate nonce assertions are only enabled in race builds")
+	}
+	h := newNonceHeap(0)
+	heap.Push(h, uint64(1))
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a duplicate push to panic")
+		}
+	}()
+	heap.Push(h, uint64(1))
+}
+
+func TestTxSortedMap_RemoveRange(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	key, _ := crypto.GenerateKey()
+	for _, i := range rand.Perm(10) {
+		txSortedMap.Put(transaction(uint64(i), 0, key))
+	}
+	var removed []uint64
+	txSortedMap.RemoveRange(3, 6, func(tx *types.Transaction) {
+		removed = append(removed, tx.Nonce())
+	})
+	if len(removed) != 4 || removed[0] != 3 || removed[3] != 6 {
+		t.Fatalf("expected nonces 3 through 6 to be removed in order, have %v", removed)
+	}
+	txSortedMap.RemoveRange(20, 30, func(tx *types.Transaction) {
+		t.Fatalf("unexpected removal of nonce %d outside the range", tx.Nonce())
+	})
+	if err := txSortedMap.invariants(); err != nil {
+		t.Fatalf("inconsistent map: %v", err)
+	}
+	nonces := txSortedMap.Nonces()
+	if len(nonces) != 6 || nonces[2] != 2 || nonces[3] != 7 {
+		t.Errorf("expected nonces [0 1 2 7 8 9] to remain, have %v", nonces)
+	}
+}
+
+func TestTxSortedMap_DropReasons(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	key, _ := crypto.GenerateKey()
+	for i := 0; i < 10; i++ {
+		txSortedMap.Put(transaction(uint64(i), uint64(i), key))
+	}
+	reasons := make(map[uint64]DropReason)
+	dropped := func(tx *types.Transaction, reason DropReason) {
+		if _, ok := reasons[tx.Nonce()]; ok {
+			t.Fatalf("nonce %d dropped twice", tx.Nonce())
+		}
+		reasons[tx.Nonce()] = reason
+	}
+	if n := txSortedMap.ForwardWithReason(2, dropped); n != 2 {
+		t.Fatalf("expected 2 forwarded txs, have %d", n)
+	}
+	if n := txSortedMap.CapWithReason(7, dropped); n != 1 {
+		t.Fatalf("expected 1 capped tx, have %d", n)
+	}
+	txSortedMap.FilterWithReason(func(tx *types.Transaction) bool { return tx.Gas() == 6 }, true, dropped)
+	txSortedMap.RemoveWithReason(4, true, dropped)
+
+	want := map[uint64]DropReason{
+		0: DropForwarded, 1: DropForwarded,
+		9: DropCapped,
+		6: DropFiltered, 7: DropInvalidated, 8: DropInvalidated,
+		5: DropInvalidated,
+	}
+	if len(reasons) != len(want) {
+		t.Fatalf("expected %d dropped txs, have %v", len(want), reasons)
+	}
+	for nonce, reason := range want {
+		if reasons[nonce] != reason {
+			t.Errorf("nonce %d: expected reason %d, have %d", nonce, reason, reasons[nonce])
+		}
+	}
+}
+
+func TestTxSortedMap_Shrink(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	key, _ := crypto.GenerateKey()
+	for i := 0; i < 1000; i++ {
+		txSortedMap.Put(transaction(uint64(i), 0, key))
+	}
+	txSortedMap.ensureCache()
+	txSortedMap.Cap(100, func(*types.Transaction) {})
+
+	// Steady-state maps are left alone
+	txSortedMap.Shrink()
+	heapCap, cacheCap := cap(txSortedMap.index.Values), cap(txSortedMap.cache)
+	txSortedMap.Shrink()
+	if cap(txSortedMap.index.Values) != heapCap || cap(txSortedMap.cache) != cacheCap {
+		t.Fatalf("expected a right-sized map not to be reallocated")
+	}
+	txSortedMap.Cap(10, func(*types.Transaction) {})
+	txSortedMap.Shrink()
+	if c := cap(txSortedMap.index.Values); c != 10 {
+		t.Errorf("expected a heap capacity of 10, have %d", c)
+	}
+	if c := cap(txSortedMap.cache); c != 10 {
+		t.Errorf("expected a cache capacity of 10, have %d", c)
+	}
+	if err := txSortedMap.invariants(); err != nil {
+		t.Errorf("inconsistent map: %v", err)
+	}
+}
+
+func TestTxSortedMap_GetByHash(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	m := newTxSortedMap()
+	txs := make(types.Transactions, 12)
+	for i := range txs {
+		txs[i] = transaction(uint64(i), 0, key)
+		m.Put(txs[i])
+	}
+	if tx := m.GetByHash(txs[5].Hash()); tx != txs[5] {
+		t.Fatalf("lookup mismatch: have %v, want %v", tx, txs[5])
+	}
+	// Replacements must drop the hash of the overwritten transaction
+	replacement := pricedTransaction(5, 0, big.NewInt(2), key)
+	m.Put(replacement)
+	if m.GetByHash(txs[5].Hash()) != nil || m.GetByHash(replacement.Hash()) != replacement {
+		t.Errorf("hash index not updated on replacement")
+	}
+	// Every removal path must clean up the hash index
+	noop := func(*types.Transaction) {}
+	m.Forward(2, noop)
+	m.Filter(func(tx *types.Transaction) bool { return tx.Nonce() == 3 }, false, noop, noop)
+	m.Remove(4, false, noop)
+	m.Ready(2, noop)
+	m.Put(txs[8])
+	m.ForLast(1, noop)
+	m.Cap(2, noop)
+
+	for _, tx := range txs {
+		if have := m.GetByHash(tx.Hash()); have != m.Get(tx.Nonce()) && have != nil {
+			t.Errorf("nonce %d: stale hash index entry", tx.Nonce())
+		}
+	}
+	if err := m.invariants(); err != nil {
+		t.Errorf("inconsistent map: %v", err)
+	}
+}
+
+// Tests that concurrent readers lazily creating the sorted cache don't race,
+// which is checked when running under the race detector.
+func TestTxSortedMap_ConcurrentReads(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	m := newTxSortedMap()
+	for i := 0; i < 64; i++ {
+		m.Put(transaction(uint64(i), 0, key))
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if txs := m.Flatten(); len(txs) != 64 {
+				t.Errorf("flatten length mismatch: have %d, want 64", len(txs))
+			}
+			if last := m.Last(); last.Nonce() != 63 {
+				t.Errorf("last nonce mismatch: have %d, want 63", last.Nonce())
+			}
+			if first := m.Peek(); first.Nonce() != 0 {
+				t.Errorf("first nonce mismatch: have %d, want 0", first.Nonce())
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Tests that the txList accessors documented as safe for concurrent reads don't
+// race, which is checked when running under the race detector.
+func TestTxList_ConcurrentReads(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for i := 0; i < 64; i++ {
+		list.Add(transaction(uint64(i), 0, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if txs := list.Flatten(); len(txs) != 64 {
+				t.Errorf("flatten length mismatch: have %d, want 64", len(txs))
+			}
+			if txs := list.FlattenView(); len(txs) != 64 {
+				t.Errorf("flatten view length mismatch: have %d, want 64", len(txs))
+			}
+			if last := list.Last(); last.Nonce() != 63 {
+				t.Errorf("last nonce mismatch: have %d, want 63", last.Nonce())
+			}
+			if first := list.Peek(); first.Nonce() != 0 {
+				t.Errorf("first nonce mismatch: have %d, want 0", first.Nonce())
+			}
+			if page := list.Page(8, 8); len(page) != 8 || page[0].Nonce() != 8 {
+				t.Errorf("page mismatch: have %d txs", len(page))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestTxSortedMap_MinNonce(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	m := newTxSortedMap()
+	if _, ok := m.MinNonce(); ok {
+		t.Fatalf("empty map reported a nonce")
+	}
+	for _, nonce := range []uint64{7, 3, 9, 5} {
+		m.Put(transaction(nonce, 0, key))
+	}
+	if nonce, ok := m.MinNonce(); !ok || nonce != 3 {
+		t.Errorf("min nonce mismatch: have %d/%v, want 3/true", nonce, ok)
+	}
+	m.Remove(3, false, func(*types.Transaction) {})
+	if nonce, ok := m.MinNonce(); !ok || nonce != 5 {
+		t.Errorf("min nonce mismatch after removal: have %d/%v, want 5/true", nonce, ok)
+	}
+}
+
+func TestTxSortedMap_MaxNonce(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	m := newTxSortedMap()
+	if _, ok := m.MaxNonce(); ok {
+		t.Fatalf("empty map reported a nonce")
+	}
+	for _, nonce := range []uint64{7, 3, 9, 5} {
+		m.Put(transaction(nonce, 0, key))
+	}
+	// Both the heap scan and the cached path must agree
+	if nonce, ok := m.MaxNonce(); !ok || nonce != 9 {
+		t.Errorf("uncached max nonce mismatch: have %d/%v, want 9/true", nonce, ok)
+	}
+	if m.cache != nil {
+		t.Errorf("max nonce lookup built the cache")
+	}
+	m.Flatten()
+	m.Remove(9, false, func(*types.Transaction) {})
+	if nonce, ok := m.MaxNonce(); !ok || nonce != 7 {
+		t.Errorf("cached max nonce mismatch: have %d/%v, want 7/true", nonce, ok)
+	}
+}
+
 func TestTxSortedMap_Ready(t *testing.T) {
 	txSortedMap := newTxSortedMap()
 
@@ -141,11 +709,66 @@ func TestTxSortedMap_Ready(t *testing.T) {
 		t.Errorf("expected to remove 4 but got %d", removed)
 	}
 
-	if len(txSortedMap.items) > 0 || len(txSortedMap.cache) > 0 || len(*txSortedMap.index) > 0 {
+	if len(txSortedMap.items) > 0 || len(txSortedMap.cache) > 0 || txSortedMap.index.Len() > 0 {
 		t.Fatalf("expected empty txSortedMap but got %#v", txSortedMap)
 	}
 }
 
+func TestTxSortedMap_ReadyFunc(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	key, _ := crypto.GenerateKey()
+	for _, i := range []uint64{0, 1, 2, 3, 5} {
+		txSortedMap.Put(transaction(i, 0, key))
+	}
+	var offered []uint64
+	txSortedMap.ReadyFunc(0, func(tx *types.Transaction) bool {
+		offered = append(offered, tx.Nonce())
+		return tx.Nonce() < 2
+	})
+	if len(offered) != 3 {
+		t.Fatalf("expected 3 txs to be offered, have %v", offered)
+	}
+	if txSortedMap.Len() != 3 || txSortedMap.Contains(1) || !txSortedMap.Contains(2) {
+		t.Fatalf("expected only the accepted txs to be removed, have %v", txSortedMap.Nonces())
+	}
+	txSortedMap.ReadyFunc(2, func(*types.Transaction) bool { return true })
+	if txSortedMap.Len() != 1 || !txSortedMap.Contains(5) {
+		t.Errorf("expected the gapped tx to remain, have %v", txSortedMap.Nonces())
+	}
+	if err := txSortedMap.invariants(); err != nil {
+		t.Errorf("inconsistent map: %v", err)
+	}
+}
+
+func TestTxSortedMap_EachGapped(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	key, _ := crypto.GenerateKey()
+	for _, i := range []uint64{3, 4, 5, 7, 8, 10} {
+		txSortedMap.Put(transaction(i, 0, key))
+	}
+	for start, want := range map[uint64][]uint64{
+		2: {3, 4, 5, 7, 8, 10},
+		3: {7, 8, 10},
+		5: {7, 8, 10},
+	} {
+		var gapped []uint64
+		txSortedMap.EachGapped(start, func(tx *types.Transaction) {
+			gapped = append(gapped, tx.Nonce())
+		})
+		if len(gapped) != len(want) {
+			t.Fatalf("start %d: expected gapped nonces %v, have %v", start, want, gapped)
+		}
+		for i := range want {
+			if gapped[i] != want[i] {
+				t.Fatalf("start %d: expected gapped nonces %v, have %v", start, want, gapped)
+			}
+		}
+	}
+	if txSortedMap.Len() != 6 {
+		t.Errorf("expected nothing to be removed, have %d txs", txSortedMap.Len())
+	}
+}
+
 func TestTxSortedMap_Forward(t *testing.T) {
 	txSortedMap := newTxSortedMap()
 
@@ -161,36 +784,79 @@ func TestTxSortedMap_Forward(t *testing.T) {
 	}
 
 	var removed int
-	txSortedMap.Forward(1, func(*types.Transaction) {
+	count := txSortedMap.Forward(1, func(*types.Transaction) {
 		removed++
 	})
-	if removed != 0 {
-		t.Fatalf("expected to remove none but got %d", removed)
+	if removed != 0 || count != 0 {
+		t.Fatalf("expected to remove none but got %d (reported %d)", removed, count)
 	}
 
 	removed = 0
-	txSortedMap.Forward(5, func(*types.Transaction) {
+	count = txSortedMap.Forward(5, func(*types.Transaction) {
 		removed++
 	})
-	if removed != 4 {
-		t.Fatalf("expected to remove 4 but got %d", removed)
+	if removed != 4 || count != 4 {
+		t.Fatalf("expected to remove 4 but got %d (reported %d)", removed, count)
 	}
 
 	txSortedMap.cache = nil
 
 	removed = 0
-	txSortedMap.Forward(10, func(*types.Transaction) {
+	count = txSortedMap.Forward(10, func(*types.Transaction) {
 		removed++
 	})
-	if removed != 4 {
-		t.Errorf("expected to remove 4 but got %d", removed)
+	if removed != 4 || count != 4 {
+		t.Errorf("expected to remove 4 but got %d (reported %d)", removed, count)
 	}
 
-	if len(txSortedMap.items) > 0 || len(txSortedMap.cache) > 0 || len(*txSortedMap.index) > 0 {
+	if len(txSortedMap.items) > 0 || len(txSortedMap.cache) > 0 || txSortedMap.index.Len() > 0 {
 		t.Fatalf("expected empty txSortedMap but got %#v", txSortedMap)
 	}
 }
 
+// Tests that Forward keeps the cache aligned with the heap when transactions are
+// inserted out of order between forwards.
+func TestTxSortedMap_ForwardInterleaved(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	key, _ := crypto.GenerateKey()
+	for _, i := range []uint64{4, 6, 8} {
+		txSortedMap.Put(transaction(i, 0, key))
+	}
+	txSortedMap.ensureCache()
+
+	// Appending keeps the cache, inserting below the highest nonce drops it
+	txSortedMap.Put(transaction(9, 0, key))
+	txSortedMap.Forward(5, func(*types.Transaction) {})
+	txSortedMap.Put(transaction(2, 0, key))
+	txSortedMap.Put(transaction(7, 0, key))
+	txSortedMap.ensureCache()
+	txSortedMap.Put(transaction(10, 0, key))
+
+	var removed []uint64
+	txSortedMap.Forward(8, func(tx *types.Transaction) {
+		removed = append(removed, tx.Nonce())
+	})
+	if len(removed) != 3 || removed[0] != 2 || removed[2] != 7 {
+		t.Fatalf("expected nonces [2 6 7] to be forwarded, have %v", removed)
+	}
+	if err := txSortedMap.invariants(); err != nil {
+		t.Fatalf("inconsistent map: %v", err)
+	}
+	// Forward the heap past a nonce the cache doesn't know about, which is
+	// asserted against in race builds
+	if txListDebug {
+		return
+	}
+	txSortedMap.cache = txSortedMap.cache[1:]
+	txSortedMap.Forward(9, func(*types.Transaction) {})
+	if txSortedMap.cache != nil {
+		t.Fatalf("expected a misaligned cache to be dropped")
+	}
+	if err := txSortedMap.invariants(); err != nil {
+		t.Errorf("inconsistent map: %v", err)
+	}
+}
+
 func TestTxSortedMap_Filter(t *testing.T) {
 	txSortedMap := newTxSortedMap()
 
@@ -222,36 +888,149 @@ func TestTxSortedMap_Filter(t *testing.T) {
 		t.Fatalf("expected 1 removal and 3 invalid but got %d removals and %d invalid", removed, invalid)
 	}
 
-	if len(txSortedMap.items) > 0 || len(txSortedMap.cache) > 0 || len(*txSortedMap.index) > 0 {
+	if len(txSortedMap.items) > 0 || len(txSortedMap.cache) > 0 || txSortedMap.index.Len() > 0 {
 		t.Fatalf("expected empty txSortedMap but got %#v", txSortedMap)
 	}
 }
 
-func TestTxSortedMap_ForLast(t *testing.T) {
+func TestTxSortedMap_EachIndexed(t *testing.T) {
 	txSortedMap := newTxSortedMap()
-
-	txs := make(types.Transactions, 10)
 	key, _ := crypto.GenerateKey()
-	for i := 1; i < 5; i++ {
-		txs[i] = transaction(uint64(i), 100, key)
-		txSortedMap.Put(txs[i])
+	for _, i := range rand.Perm(10) {
+		txSortedMap.Put(transaction(uint64(2*i), 0, key))
 	}
-	for i := 6; i < len(txs); i++ {
-		txs[i] = transaction(uint64(i), 200, key)
-		txSortedMap.Put(txs[i])
+	var visited int
+	txSortedMap.EachIndexed(func(i int, tx *types.Transaction) bool {
+		if i != visited || tx.Nonce() != uint64(2*i) {
+			t.Fatalf("expected position %d with nonce %d, have %d with %d", visited, 2*visited, i, tx.Nonce())
+		}
+		visited++
+		return i < 4
+	})
+	if visited != 5 {
+		t.Fatalf("expected the walk to stop after 5 txs, have %d", visited)
 	}
-
-	var cnt int
-	fn := func(*types.Transaction) { cnt++ }
-	txSortedMap.ForLast(2, fn)
-	if cnt != 2 {
-		t.Errorf("expected 2 but got %d", cnt)
+	if txSortedMap.Len() != 10 {
+		t.Errorf("expected nothing to be removed, have %d txs", txSortedMap.Len())
 	}
+}
 
-	txSortedMap.cache = nil
+func TestTxSortedMap_RevEach(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	txSortedMap.RevEach(func(tx *types.Transaction) bool {
+		t.Fatalf("unexpected tx %v in an empty map", tx)
+		return true
+	})
 
-	cnt = 0
-	txSortedMap.ForLast(4, fn)
+	key, _ := crypto.GenerateKey()
+	for _, i := range rand.Perm(10) {
+		txSortedMap.Put(transaction(uint64(i), 0, key))
+	}
+	var nonces []uint64
+	txSortedMap.RevEach(func(tx *types.Transaction) bool {
+		nonces = append(nonces, tx.Nonce())
+		return len(nonces) < 4
+	})
+	if len(nonces) != 4 {
+		t.Fatalf("expected the walk to stop after 4 txs, have %d", len(nonces))
+	}
+	for i, nonce := range nonces {
+		if want := uint64(9 - i); nonce != want {
+			t.Errorf("tx %d: expected nonce %d but got %d", i, want, nonce)
+		}
+	}
+	if txSortedMap.Len() != 10 {
+		t.Errorf("expected nothing to be removed, have %d txs", txSortedMap.Len())
+	}
+}
+
+func TestTxSortedMap_Select(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	key, _ := crypto.GenerateKey()
+	for _, i := range rand.Perm(10) {
+		txSortedMap.Put(transaction(uint64(i), uint64(i*100), key))
+	}
+	gen := txSortedMap.gen
+	matches := txSortedMap.Select(func(tx *types.Transaction) bool {
+		return tx.Gas() >= 500
+	})
+	if len(matches) != 5 {
+		t.Fatalf("expected 5 matches, have %d", len(matches))
+	}
+	for i, tx := range matches {
+		if want := uint64(5 + i); tx.Nonce() != want {
+			t.Errorf("match %d: expected nonce %d but got %d", i, want, tx.Nonce())
+		}
+	}
+	if txSortedMap.Len() != 10 || txSortedMap.gen != gen {
+		t.Errorf("expected the map to be untouched, have %d txs", txSortedMap.Len())
+	}
+}
+
+func TestTxSortedMap_FilterStrictLast(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	key, _ := crypto.GenerateKey()
+	for _, i := range rand.Perm(10) {
+		txSortedMap.Put(transaction(uint64(i), uint64(i), key))
+	}
+	var removed []uint64
+	txSortedMap.Filter(func(tx *types.Transaction) bool { return tx.Gas() >= 9 }, true, func(tx *types.Transaction) {
+		removed = append(removed, tx.Nonce())
+	}, func(tx *types.Transaction) {
+		t.Fatalf("unexpected invalidation of nonce %d", tx.Nonce())
+	})
+	if len(removed) != 1 || removed[0] != 9 {
+		t.Fatalf("expected nonce 9 to be removed, have %v", removed)
+	}
+	if err := txSortedMap.invariants(); err != nil {
+		t.Fatalf("inconsistent map: %v", err)
+	}
+	if tx := txSortedMap.Last(); tx.Nonce() != 8 {
+		t.Errorf("expected nonce 8 to be the highest left, have %d", tx.Nonce())
+	}
+}
+
+func TestTxSortedMap_FirstAbove(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	key, _ := crypto.GenerateKey()
+	for _, i := range []uint64{2, 3, 7} {
+		txSortedMap.Put(transaction(i, 0, key))
+	}
+	for threshold, want := range map[uint64]uint64{0: 2, 2: 3, 3: 7, 5: 7} {
+		if tx, ok := txSortedMap.FirstAbove(threshold); !ok || tx.Nonce() != want {
+			t.Errorf("threshold %d: expected nonce %d, have %v", threshold, want, tx)
+		}
+	}
+	if tx, ok := txSortedMap.FirstAbove(7); ok || tx != nil {
+		t.Errorf("expected nothing above the highest nonce, have %v", tx)
+	}
+}
+
+func TestTxSortedMap_ForLast(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+
+	txs := make(types.Transactions, 10)
+	key, _ := crypto.GenerateKey()
+	for i := 1; i < 5; i++ {
+		txs[i] = transaction(uint64(i), 100, key)
+		txSortedMap.Put(txs[i])
+	}
+	for i := 6; i < len(txs); i++ {
+		txs[i] = transaction(uint64(i), 200, key)
+		txSortedMap.Put(txs[i])
+	}
+
+	var cnt int
+	fn := func(*types.Transaction) { cnt++ }
+	txSortedMap.ForLast(2, fn)
+	if cnt != 2 {
+		t.Errorf("expected 2 but got %d", cnt)
+	}
+
+	txSortedMap.cache = nil
+
+	cnt = 0
+	txSortedMap.ForLast(4, fn)
 	if cnt != 4 {
 		t.Errorf("expected 6 but got %d", cnt)
 	}
@@ -264,7 +1043,2214 @@ func TestTxSortedMap_ForLast(t *testing.T) {
 		t.Errorf("expected 8 but got %d", cnt)
 	}
 
-	if len(txSortedMap.items) > 0 || len(txSortedMap.cache) > 0 || len(*txSortedMap.index) > 0 {
+	if len(txSortedMap.items) > 0 || len(txSortedMap.cache) > 0 || txSortedMap.index.Len() > 0 {
 		t.Fatalf("expected empty txSortedMap but got %#v", txSortedMap)
 	}
 }
+
+func TestTxSortedMap_LastN(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+	if txs := txSortedMap.LastN(3); txs == nil || len(txs) != 0 {
+		t.Fatalf("expected an empty slice for an empty map but got %v", txs)
+	}
+
+	key, _ := crypto.GenerateKey()
+	for _, i := range rand.Perm(10) {
+		txSortedMap.Put(transaction(uint64(i), 0, key))
+	}
+	for _, tt := range []struct{ n, want int }{{0, 0}, {3, 3}, {10, 10}, {20, 10}, {-1, 0}} {
+		txs := txSortedMap.LastN(tt.n)
+		if len(txs) != tt.want {
+			t.Fatalf("n=%d: expected %d txs but got %d", tt.n, tt.want, len(txs))
+		}
+		for i, tx := range txs {
+			if want := uint64(10 - tt.want + i); tx.Nonce() != want {
+				t.Errorf("n=%d: tx %d: expected nonce %d but got %d", tt.n, i, want, tx.Nonce())
+			}
+		}
+	}
+	if txSortedMap.Len() != 10 || txSortedMap.index.Len() != 10 {
+		t.Errorf("expected nothing to be removed, have %d txs and %d index entries", txSortedMap.Len(), txSortedMap.index.Len())
+	}
+}
+
+func TestTxList_WeightedAvgGasPrice(t *testing.T) {
+	list := newTxList(false)
+	if avg := list.WeightedAvgGasPrice(nil); avg != nil {
+		t.Fatalf("expected nil for empty list but got %v", avg)
+	}
+
+	key, _ := crypto.GenerateKey()
+	list.Add(pricedTransaction(0, 100, big.NewInt(1), key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Add(pricedTransaction(1, 200, big.NewInt(2), key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Add(pricedTransaction(2, 700, big.NewInt(4), key), DefaultTxPoolConfig.PriceBump, nil)
+
+	// (1*100 + 2*200 + 4*700) / 1000 = 3.3
+	if avg := list.WeightedAvgGasPrice(nil); avg.Cmp(big.NewInt(3)) != 0 {
+		t.Errorf("expected weighted average 3 but got %v", avg)
+	}
+}
+
+func TestTxList_InvalidatePriceCache(t *testing.T) {
+	list := newTxList(false)
+
+	key, _ := crypto.GenerateKey()
+	for i, price := range []int64{3, 1, 2} {
+		list.Add(pricedTransaction(uint64(i), 100, big.NewInt(price), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	list.Flatten()
+	if top := list.TopByPrice(1); len(top) != 1 || top[0].Nonce() != 0 {
+		t.Fatalf("expected nonce 0 to be the top priced tx but got %v", top)
+	}
+
+	list.Reprice(big.NewInt(1))
+	if list.priced != nil {
+		t.Fatalf("expected price cache to be dropped")
+	}
+	if list.txs.cache == nil {
+		t.Fatalf("expected nonce cache to stay warm")
+	}
+	top := list.TopByPrice(3)
+	if len(top) != 3 || top[0].Nonce() != 0 || top[1].Nonce() != 2 || top[2].Nonce() != 1 {
+		t.Fatalf("unexpected price ordering %v", top)
+	}
+
+	// Mutations must invalidate the price ordering as well.
+	list.Add(pricedTransaction(3, 100, big.NewInt(4), key), DefaultTxPoolConfig.PriceBump, nil)
+	if top := list.TopByPrice(1); top[0].Nonce() != 3 {
+		t.Errorf("expected nonce 3 to be the top priced tx but got %d", top[0].Nonce())
+	}
+}
+
+func TestTxList_DetectOscillation(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	a := pricedTransaction(0, 100, big.NewInt(1), key)
+	b := pricedTransaction(0, 100, big.NewInt(2), key)
+
+	list := newTxList(false)
+	list.TrackHistory()
+
+	// Simulate two submitters re-injecting their own transaction every time it
+	// gets dropped: A -> B -> A -> B.
+	list.Add(a, DefaultTxPoolConfig.PriceBump, nil)
+	list.Add(b, DefaultTxPoolConfig.PriceBump, nil)
+	if list.DetectOscillation(0, 4) {
+		t.Fatalf("expected no oscillation before the window is filled")
+	}
+	list.Remove(b, func(*types.Transaction) {})
+	list.Add(a, DefaultTxPoolConfig.PriceBump, nil)
+	list.Remove(a, func(*types.Transaction) {})
+	list.Add(b, DefaultTxPoolConfig.PriceBump, nil)
+	if !list.DetectOscillation(0, 4) {
+		t.Fatalf("expected oscillation to be detected")
+	}
+
+	// Plain fee bumps never revisit a hash.
+	bumps := newTxList(false)
+	bumps.TrackHistory()
+	for i := int64(1); i <= 4; i++ {
+		bumps.Add(pricedTransaction(0, 100, big.NewInt(i*10), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	if bumps.DetectOscillation(0, 4) {
+		t.Errorf("expected fee bumps not to be reported as oscillation")
+	}
+
+	list.Forward(1, func(*types.Transaction) {})
+	if list.DetectOscillation(0, 4) {
+		t.Errorf("expected history to be pruned by Forward")
+	}
+}
+
+func TestTxList_Freeze(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	list.Add(pricedTransaction(0, 100, big.NewInt(1), key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Freeze(0, 10)
+
+	replacement := pricedTransaction(0, 100, big.NewInt(10), key)
+	if ok, _, reason := list.AddWith(replacement, txAddOpts{priceBump: DefaultTxPoolConfig.PriceBump, currentBlock: 10}); ok || reason != RejectedFrozen {
+		t.Fatalf("expected frozen rejection but got accepted=%v reason=%d", ok, reason)
+	}
+	// Fresh nonces are not affected by the freeze.
+	if ok, _, _ := list.AddWith(pricedTransaction(1, 100, big.NewInt(1), key), txAddOpts{currentBlock: 10}); !ok {
+		t.Fatalf("expected insert at an unfrozen nonce to be accepted")
+	}
+	ok, old, reason := list.AddWith(replacement, txAddOpts{priceBump: DefaultTxPoolConfig.PriceBump, currentBlock: 11})
+	if !ok || old == nil || reason != AddAccepted {
+		t.Fatalf("expected replacement after thaw but got accepted=%v reason=%d", ok, reason)
+	}
+	if _, ok := list.frozen[0]; ok {
+		t.Errorf("expected nonce to be unfrozen")
+	}
+}
+
+func TestTxList_Thaw(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	list.Add(pricedTransaction(0, 100, big.NewInt(1), key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Add(pricedTransaction(1, 100, big.NewInt(1), key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Freeze(0, 10)
+	list.Freeze(1, 20)
+
+	// Add doesn't know the head, so only an explicit thaw lifts the freeze
+	if ok, _ := list.Add(pricedTransaction(0, 100, big.NewInt(10), key), DefaultTxPoolConfig.PriceBump, nil); ok {
+		t.Fatalf("expected frozen nonce to reject the replacement")
+	}
+	list.Thaw(11)
+	if ok, _ := list.Add(pricedTransaction(0, 100, big.NewInt(10), key), DefaultTxPoolConfig.PriceBump, nil); !ok {
+		t.Fatalf("expected thawed nonce to accept the replacement")
+	}
+	if ok, _ := list.Add(pricedTransaction(1, 100, big.NewInt(10), key), DefaultTxPoolConfig.PriceBump, nil); ok {
+		t.Errorf("expected nonce frozen past the head to stay frozen")
+	}
+	// A head learned from any insertion thaws the freezes for Add as well
+	list.AddWith(pricedTransaction(2, 100, big.NewInt(1), key), txAddOpts{currentBlock: 21})
+	if ok, _ := list.Add(pricedTransaction(1, 100, big.NewInt(10), key), DefaultTxPoolConfig.PriceBump, nil); !ok {
+		t.Errorf("expected nonce frozen before the learned head to be thawed")
+	}
+}
+
+func TestTxList_FlattenByArrival(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for i := 0; i < 4; i++ {
+		list.Add(transaction(uint64(i), 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	now := time.Now()
+	list.txs.arrivals[0] = now.Add(3 * time.Second)
+	list.txs.arrivals[1] = now.Add(1 * time.Second)
+	list.txs.arrivals[2] = now.Add(2 * time.Second)
+	list.txs.arrivals[3] = now.Add(1 * time.Second)
+
+	want := []uint64{1, 3, 2, 0}
+	txs := list.FlattenByArrival()
+	if len(txs) != len(want) {
+		t.Fatalf("expected %d txs but got %d", len(want), len(txs))
+	}
+	for i, tx := range txs {
+		if tx.Nonce() != want[i] {
+			t.Errorf("position %d: expected nonce %d but got %d", i, want[i], tx.Nonce())
+		}
+	}
+
+	list.Forward(2, func(*types.Transaction) {})
+	if len(list.txs.arrivals) != 2 {
+		t.Errorf("expected forwarded arrivals to be dropped, have %d", len(list.txs.arrivals))
+	}
+}
+
+func TestTxList_FlattenTransform(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for i := 0; i < 4; i++ {
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), common.Address{}, big.NewInt(100), 100, big.NewInt(1), []byte{0xde, 0xad}), types.HomesteadSigner{}, key)
+		list.Add(tx, DefaultTxPoolConfig.PriceBump, nil)
+	}
+	redacted := list.FlattenTransform(func(tx *types.Transaction) *types.Transaction {
+		if tx.Nonce() == 2 {
+			return nil
+		}
+		return types.NewTransaction(tx.Nonce(), *tx.To(), tx.Value(), tx.Gas(), tx.GasPrice(), nil)
+	})
+	if len(redacted) != 3 {
+		t.Fatalf("expected 3 txs but got %d", len(redacted))
+	}
+	for i, want := range []uint64{0, 1, 3} {
+		if redacted[i].Nonce() != want {
+			t.Errorf("position %d: expected nonce %d but got %d", i, want, redacted[i].Nonce())
+		}
+		if len(redacted[i].Data()) != 0 {
+			t.Errorf("position %d: expected redacted calldata", i)
+		}
+	}
+	for _, tx := range list.Flatten() {
+		if len(tx.Data()) != 2 {
+			t.Errorf("nonce %d: stored transaction was modified", tx.Nonce())
+		}
+	}
+}
+
+func TestTxList_FilterAffordable(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(true)
+	for i := 0; i < 5; i++ {
+		list.Add(transaction(uint64(i), 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	// Every tx costs 100 gas * 1 wei + 100 wei value = 200 wei.
+	var removed []uint64
+	list.FilterAffordable(big.NewInt(500), 0, func(tx *types.Transaction) {
+		removed = append(removed, tx.Nonce())
+	})
+	if len(removed) != 3 || removed[0] != 2 || removed[1] != 3 || removed[2] != 4 {
+		t.Fatalf("expected nonces [2 3 4] to be removed but got %v", removed)
+	}
+	if list.Len() != 2 {
+		t.Errorf("expected 2 txs to remain but got %d", list.Len())
+	}
+
+	removed = nil
+	list.FilterAffordable(big.NewInt(400), 0, func(tx *types.Transaction) {
+		removed = append(removed, tx.Nonce())
+	})
+	if len(removed) != 0 {
+		t.Errorf("expected nothing to be removed but got %v", removed)
+	}
+	// Removed transactions must be gone when reported, and the caps lowered
+	list = newTxList(false)
+	list.Add(transaction(0, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Add(transaction(1, 1000, key), DefaultTxPoolConfig.PriceBump, nil)
+	list.FilterAffordable(big.NewInt(500), 0, func(tx *types.Transaction) {
+		if list.txs.Get(tx.Nonce()) != nil {
+			t.Errorf("nonce %d reported before being removed", tx.Nonce())
+		}
+	})
+	if list.Len() != 1 {
+		t.Fatalf("expected 1 tx to remain but got %d", list.Len())
+	}
+	if list.costcap.Uint64() != 200 || list.gascap != 100 {
+		t.Errorf("expected caps of 200 wei and 100 gas but got %v and %d", list.costcap, list.gascap)
+	}
+}
+
+func TestTxListStats(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	create, _ := types.SignTx(types.NewContractCreation(0, big.NewInt(0), 300, big.NewInt(1), nil), types.HomesteadSigner{}, key)
+
+	first := newTxList(false)
+	first.Add(transaction(0, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	first.Add(pricedTransaction(0, 100, big.NewInt(2), key), DefaultTxPoolConfig.PriceBump, nil)
+	first.Add(transaction(1, 200, key), DefaultTxPoolConfig.PriceBump, nil)
+
+	second := newTxList(true)
+	second.Add(create, DefaultTxPoolConfig.PriceBump, nil)
+
+	stats := aggregateTxListStats([]*txList{first, second})
+	want := txListStats{Txs: 3, Gas: 600, Calls: 2, Creations: 1, Replacements: 1}
+	for _, tx := range append(first.Flatten(), second.Flatten()...) {
+		want.Bytes += uint64(tx.Size())
+	}
+	if stats != want {
+		t.Fatalf("stats mismatch: have %+v, want %+v", stats, want)
+	}
+
+	var buf bytes.Buffer
+	if err := stats.WritePrometheus(&buf, "txpool_"); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE txpool_txs gauge\ntxpool_txs 3\n",
+		"txpool_txs_by_type{type=\"call\"} 2\ntxpool_txs_by_type{type=\"create\"} 1\n",
+		"# TYPE txpool_replacements_total counter\ntxpool_replacements_total 1\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("expected output to contain %q, have:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestTxList_Fingerprint(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	txs := make(types.Transactions, 4)
+	for i := range txs {
+		txs[i] = transaction(uint64(i), 100, key)
+	}
+	first, second := newTxList(false), newTxList(false)
+	for i := range txs {
+		first.Add(txs[i], DefaultTxPoolConfig.PriceBump, nil)
+		second.Add(txs[len(txs)-1-i], DefaultTxPoolConfig.PriceBump, nil)
+	}
+	if first.Fingerprint() != second.Fingerprint() {
+		t.Fatalf("expected identical contents to have identical fingerprints")
+	}
+
+	gen := second.Generation()
+	second.Add(pricedTransaction(3, 100, big.NewInt(2), key), DefaultTxPoolConfig.PriceBump, nil)
+	if second.Generation() == gen {
+		t.Fatalf("expected generation to change after a replacement")
+	}
+	if first.Fingerprint() == second.Fingerprint() {
+		t.Fatalf("expected a replacement to change the fingerprint")
+	}
+
+	first.Remove(txs[3], func(*types.Transaction) {})
+	if first.Fingerprint() == second.Fingerprint() {
+		t.Errorf("expected a removal to change the fingerprint")
+	}
+}
+
+func TestTxList_TotalCost(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	if cost, gas := list.TotalCost(), list.TotalGas(); cost.Sign() != 0 || gas != 0 {
+		t.Fatalf("expected zero totals for an empty list, have cost %v and gas %d", cost, gas)
+	}
+	for i := 0; i < 4; i++ {
+		list.Add(transaction(uint64(i), uint64(100*(i+1)), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	// Costs are gas + 100 value at a gas price of 1
+	if cost, gas := list.TotalCost(), list.TotalGas(); cost.Uint64() != 1400 || gas != 1000 {
+		t.Fatalf("expected cost 1400 and gas 1000, have cost %v and gas %d", cost, gas)
+	}
+	list.TotalCost().SetUint64(0)
+	if cost := list.TotalCost(); cost.Uint64() != 1400 {
+		t.Fatalf("expected the cached cost to be unaffected by callers, have %v", cost)
+	}
+
+	list.Add(pricedTransaction(3, 400, big.NewInt(2), key), DefaultTxPoolConfig.PriceBump, nil)
+	if cost, gas := list.TotalCost(), list.TotalGas(); cost.Uint64() != 1800 || gas != 1000 {
+		t.Fatalf("expected cost 1800 and gas 1000 after a replacement, have cost %v and gas %d", cost, gas)
+	}
+	list.Forward(2, func(*types.Transaction) {})
+	if cost, gas := list.TotalCost(), list.TotalGas(); cost.Uint64() != 1300 || gas != 700 {
+		t.Errorf("expected cost 1300 and gas 700 after a removal, have cost %v and gas %d", cost, gas)
+	}
+	list.Cap(1, func(*types.Transaction) {})
+	if cost, gas := list.TotalCost(), list.TotalGas(); cost.Uint64() != 400 || gas != 300 {
+		t.Errorf("expected cost 400 and gas 300 after capping, have cost %v and gas %d", cost, gas)
+	}
+}
+
+func TestTxList_SumCostUpTo(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, nonce := range []uint64{1, 2, 4} {
+		list.Add(transaction(nonce, 100*nonce, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	// Costs are gas + 100 value at a gas price of 1
+	for nonce, want := range map[uint64]uint64{0: 0, 1: 0, 2: 200, 3: 500, 4: 500, 5: 1000} {
+		if sum := list.SumCostUpTo(nonce); sum.Uint64() != want {
+			t.Errorf("nonce %d: expected cost %d, have %v", nonce, want, sum)
+		}
+	}
+}
+
+func TestTxList_ForwardApproved(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for i := 0; i < 6; i++ {
+		list.Add(transaction(uint64(i), 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	list.Flatten()
+
+	var removed []uint64
+	list.ForwardApproved(4, func(tx *types.Transaction) bool {
+		return tx.Nonce() != 1
+	}, func(tx *types.Transaction) {
+		removed = append(removed, tx.Nonce())
+	})
+	if len(removed) != 3 || removed[0] != 0 || removed[1] != 2 || removed[2] != 3 {
+		t.Fatalf("expected nonces [0 2 3] to be removed but got %v", removed)
+	}
+	txs := list.Flatten()
+	if len(txs) != 3 || txs[0].Nonce() != 1 || txs[1].Nonce() != 4 || txs[2].Nonce() != 5 {
+		t.Fatalf("unexpected remaining txs %v", txs)
+	}
+
+	removed = nil
+	list.ForwardApproved(5, nil, func(tx *types.Transaction) {
+		removed = append(removed, tx.Nonce())
+	})
+	if len(removed) != 2 || list.Len() != 1 {
+		t.Errorf("expected default behavior to remove everything below the threshold, removed %v", removed)
+	}
+}
+
+func TestTxList_Snapshot(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(true)
+	for i := 0; i < 4; i++ {
+		list.Add(pricedTransaction(uint64(i), uint64(100*(i+1)), big.NewInt(int64(i+1)), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	snap := list.Snapshot()
+
+	restored, err := newTxListFromSnapshot(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.costcap.Cmp(list.costcap) != 0 || restored.gascap != list.gascap {
+		t.Fatalf("caps mismatch: have %v/%d, want %v/%d", restored.costcap, restored.gascap, list.costcap, list.gascap)
+	}
+	if !restored.strict || restored.Fingerprint() != list.Fingerprint() {
+		t.Fatalf("restored list differs from the original")
+	}
+
+	validateTxListSnapshots = true
+	defer func() { validateTxListSnapshots = false }()
+
+	if _, err := newTxListFromSnapshot(snap); err != nil {
+		t.Fatalf("expected untouched snapshot to validate: %v", err)
+	}
+	snap.GasCap = 100
+	if _, err := newTxListFromSnapshot(snap); err == nil {
+		t.Errorf("expected tampered snapshot to fail validation")
+	}
+}
+
+func TestRestoreTxList(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(true)
+	for i := 0; i < 4; i++ {
+		list.Add(pricedTransaction(uint64(i), uint64(100*(i+1)), big.NewInt(int64(i+1)), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	snap := list.Snapshot()
+	snap.GasCap = 1 // Stale caps must not survive a restart
+
+	blob, err := rlp.EncodeToBytes(snap)
+	if err != nil {
+		t.Fatalf("failed to encode state: %v", err)
+	}
+	var state txListState
+	if err := rlp.DecodeBytes(blob, &state); err != nil {
+		t.Fatalf("failed to decode state: %v", err)
+	}
+	restored := RestoreTxList(state)
+	if restored.costcap.Cmp(list.costcap) != 0 || restored.gascap != list.gascap {
+		t.Fatalf("caps mismatch: have %v/%d, want %v/%d", restored.costcap, restored.gascap, list.costcap, list.gascap)
+	}
+	if !restored.strict || restored.Fingerprint() != list.Fingerprint() {
+		t.Fatalf("restored list differs from the original")
+	}
+	if err := restored.txs.invariants(); err != nil {
+		t.Errorf("inconsistent restored list: %v", err)
+	}
+}
+
+func TestTxList_MaxNonceGap(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	list.SetMaxNonceGap(16)
+
+	// Without a known account nonce, the first insertion can't be bounded
+	unknown := newTxList(false)
+	unknown.SetMaxNonceGap(16)
+	if ok, _ := unknown.Add(transaction(100, 100, key), DefaultTxPoolConfig.PriceBump, nil); !ok {
+		t.Fatalf("expected the first tx of an account with an unknown nonce to be accepted")
+	}
+	if ok, _ := unknown.Add(transaction(117, 100, key), DefaultTxPoolConfig.PriceBump, nil); ok {
+		t.Fatalf("expected tx past the highest nonce plus gap to be rejected")
+	}
+	base := uint64(10)
+	if ok, _, reason := list.AddWith(transaction(27, 100, key), txAddOpts{base: &base}); ok || reason != RejectedGapTooLarge {
+		t.Fatalf("expected far-future tx to be rejected on an empty list, have accepted=%v reason=%d", ok, reason)
+	}
+	if ok, _, _ := list.AddWith(transaction(26, 100, key), txAddOpts{base: &base}); !ok {
+		t.Fatalf("expected tx within the gap to be accepted")
+	}
+	if ok, _, reason := list.AddWith(transaction(43, 100, key), txAddOpts{base: &base}); ok || reason != RejectedGapTooLarge {
+		t.Fatalf("expected tx past the highest nonce plus gap to be rejected, have accepted=%v reason=%d", ok, reason)
+	}
+	if ok, _, _ := list.AddWith(transaction(42, 100, key), txAddOpts{base: &base}); !ok {
+		t.Errorf("expected tx within the gap of the highest nonce to be accepted")
+	}
+}
+
+func TestTxList_ReadyRLP(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	first, second := newTxList(false), newTxList(false)
+	for _, nonce := range []uint64{3, 4, 5, 7} {
+		tx := transaction(nonce, 100, key)
+		first.Add(tx, DefaultTxPoolConfig.PriceBump, nil)
+		second.Add(tx, DefaultTxPoolConfig.PriceBump, nil)
+	}
+	var want types.Transactions
+	first.Ready(3, func(tx *types.Transaction) {
+		want = append(want, tx)
+	})
+
+	blob, err := second.ReadyRLP(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have types.Transactions
+	if err := rlp.DecodeBytes(blob, &have); err != nil {
+		t.Fatal(err)
+	}
+	if len(have) != len(want) {
+		t.Fatalf("expected %d txs but got %d", len(want), len(have))
+	}
+	for i := range want {
+		if have[i].Hash() != want[i].Hash() {
+			t.Errorf("tx %d: hash mismatch: have %x, want %x", i, have[i].Hash(), want[i].Hash())
+		}
+	}
+	if second.Len() != 1 {
+		t.Errorf("expected the ready txs to be drained, %d left", second.Len())
+	}
+}
+
+func TestTxSortedMap_Comparisons(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+
+	key, _ := crypto.GenerateKey()
+	const n = 1024
+	for _, i := range rand.Perm(n) {
+		txSortedMap.Put(transaction(uint64(i), 0, key))
+	}
+	txSortedMap.ensureCache()
+	if cmps := txSortedMap.Comparisons(); cmps != 0 {
+		t.Fatalf("expected no comparisons to be counted by default but got %d", cmps)
+	}
+
+	txSortedMap.CountComparisons(true)
+	txSortedMap.cache = nil
+	txSortedMap.ensureCache()
+
+	// n*log2(n) = 10240, allow for the constant factors of the sort
+	if cmps := txSortedMap.Comparisons(); cmps < n || cmps > 3*10240 {
+		t.Errorf("expected roughly n log n comparisons but got %d", cmps)
+	}
+}
+
+func TestTxList_Partition(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, nonce := range []uint64{5, 6, 7, 9, 10, 12} {
+		list.Add(transaction(nonce, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	pending, queued := list.Partition(5)
+	if !list.Empty() {
+		t.Fatalf("expected original list to be emptied, have %d txs", list.Len())
+	}
+	if !pending.strict || queued.strict {
+		t.Fatalf("unexpected strictness: pending %v, queued %v", pending.strict, queued.strict)
+	}
+	if pending.Len() != 3 || queued.Len() != 3 {
+		t.Fatalf("expected 3 pending and 3 queued txs, have %d and %d", pending.Len(), queued.Len())
+	}
+
+	// The pending list must be fully executable from the base.
+	var ready int
+	pending.Ready(5, func(*types.Transaction) { ready++ })
+	if ready != 3 {
+		t.Errorf("expected all 3 pending txs to be ready but got %d", ready)
+	}
+	// The queued list holds the gapped tail and becomes executable once filled.
+	ready = 0
+	queued.Ready(8, func(*types.Transaction) { ready++ })
+	if ready != 0 {
+		t.Errorf("expected no queued txs to be ready but got %d", ready)
+	}
+	queued.Add(transaction(8, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	queued.Ready(8, func(*types.Transaction) { ready++ })
+	if ready != 3 || queued.Len() != 1 {
+		t.Errorf("expected filled gap to make 3 queued txs ready, have %d ready and %d left", ready, queued.Len())
+	}
+}
+
+func TestTxList_PartitionKeepsConfig(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+
+	list := newTxListForSender(false, sender)
+	list.SetMaxCost(big.NewInt(1000))
+	list.TrackHistory()
+	for _, nonce := range []uint64{0, 1, 3} {
+		list.Add(transaction(nonce, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	list.Add(pricedTransaction(3, 100, big.NewInt(2), key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Freeze(1, 10)
+
+	pending, queued := list.Partition(0)
+	for name, part := range map[string]*txList{"pending": pending, "queued": queued} {
+		// Costs are gas + 100 value at a gas price of 1, so 1000 can't fit
+		if ok, _ := part.Add(transaction(5, 900, key), DefaultTxPoolConfig.PriceBump, nil); ok {
+			t.Errorf("%s: budget lost on partitioning", name)
+		}
+		if part.sender == nil || *part.sender != sender {
+			t.Errorf("%s: sender check lost on partitioning", name)
+		}
+	}
+	// The per-nonce metadata must follow the transactions
+	if _, ok := pending.frozen[1]; !ok {
+		t.Errorf("freeze of nonce 1 not moved to the pending list")
+	}
+	if queued.ReplacementCount(3) != 1 || len(queued.history[3]) != 2 {
+		t.Errorf("replacement metadata of nonce 3 not moved to the queued list")
+	}
+	if len(list.frozen) != 0 || len(list.history) != 0 {
+		t.Errorf("metadata left behind in the original list")
+	}
+}
+
+func TestTxList_OnReplace(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+
+	var calls [][2]*types.Transaction
+	list.OnReplace(func(old, tx *types.Transaction) {
+		calls = append(calls, [2]*types.Transaction{old, tx})
+	})
+	loser := pricedTransaction(0, 100, big.NewInt(1), key)
+	winner := pricedTransaction(0, 100, big.NewInt(2), key)
+
+	list.Add(loser, DefaultTxPoolConfig.PriceBump, nil)
+	list.Add(transaction(1, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	if len(calls) != 0 {
+		t.Fatalf("expected no callback for plain adds but got %d", len(calls))
+	}
+	list.Add(winner, DefaultTxPoolConfig.PriceBump, nil)
+	if len(calls) != 1 || calls[0][0] != loser || calls[0][1] != winner {
+		t.Fatalf("expected a single callback with the loser and winner, have %v", calls)
+	}
+	list.Add(loser, DefaultTxPoolConfig.PriceBump, nil)
+	if len(calls) != 1 {
+		t.Errorf("expected no callback for a rejected replacement")
+	}
+}
+
+func TestTxList_GasPricePercentiles(t *testing.T) {
+	list := newTxList(false)
+	if ps := list.GasPricePercentiles([]float64{50}, nil); len(ps) != 1 || ps[0] != nil {
+		t.Fatalf("expected nil percentiles for an empty list but got %v", ps)
+	}
+
+	key, _ := crypto.GenerateKey()
+	for _, i := range rand.Perm(10) {
+		list.Add(pricedTransaction(uint64(i), 100, big.NewInt(int64(i+1)), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	want := []int64{1, 1, 5, 9, 10}
+	have := list.GasPricePercentiles([]float64{0, 10, 50, 90, 100}, nil)
+	for i := range want {
+		if have[i].Cmp(big.NewInt(want[i])) != 0 {
+			t.Errorf("percentile %d: have %v, want %d", i, have[i], want[i])
+		}
+	}
+	// Querying at a different base fee must not reprice the list itself
+	list.TopByPrice(1)
+	cached := list.priced
+	list.GasPricePercentiles([]float64{50}, big.NewInt(7))
+	MergeByPrice([]*txList{list}, big.NewInt(7))
+	if list.baseFee != nil {
+		t.Errorf("query base fee stored on the list: %v", list.baseFee)
+	}
+	if len(list.priced) == 0 || &list.priced[0] != &cached[0] {
+		t.Errorf("price cache dropped by a query at a different base fee")
+	}
+}
+
+func TestTxList_ReadyTentative(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, nonce := range []uint64{0, 1, 2, 4} {
+		list.Add(transaction(nonce, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	nonces := func(txs types.Transactions) []uint64 {
+		var ns []uint64
+		for _, tx := range txs {
+			ns = append(ns, tx.Nonce())
+		}
+		return ns
+	}
+
+	ready := list.ReadyTentative(0)
+	if len(ready) != 3 || list.Len() != 4 {
+		t.Fatalf("expected 3 tentative txs with nothing removed, have %v and %d txs", nonces(ready), list.Len())
+	}
+	if again := list.ReadyTentative(0); len(again) != 0 {
+		t.Fatalf("expected in-flight txs to be excluded but got %v", nonces(again))
+	}
+
+	// Nack path: the txs become available again.
+	list.NackReady([]uint64{1, 2})
+	if again := list.ReadyTentative(0); len(again) != 2 || again[0].Nonce() != 1 || again[1].Nonce() != 2 {
+		t.Fatalf("expected nacked txs to be handed out again but got %v", nonces(again))
+	}
+
+	// Ack path: the txs get removed.
+	list.AckReady([]uint64{0, 1, 2})
+	if list.Len() != 1 || list.Overlaps(transaction(0, 100, key)) {
+		t.Fatalf("expected acked txs to be removed, %d left", list.Len())
+	}
+	if again := list.ReadyTentative(3); len(again) != 0 {
+		t.Errorf("expected nothing ready past the gap but got %v", nonces(again))
+	}
+}
+
+func TestTxList_ReadyTentativeStrict(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(true)
+	for i := 0; i < 4; i++ {
+		list.Add(transaction(uint64(i), 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	list.ReadyTentative(0)
+
+	// Acking a nonce past the front must not punch a gap into the list
+	list.AckReady([]uint64{1})
+	if want := []uint64{0, 1, 2, 3}; !reflect.DeepEqual(list.txs.Nonces(), want) {
+		t.Fatalf("non-prefix ack modified the list: have %v, want %v", list.txs.Nonces(), want)
+	}
+	list.AckReady([]uint64{1, 0})
+	if want := []uint64{2, 3}; !reflect.DeepEqual(list.txs.Nonces(), want) {
+		t.Fatalf("prefix ack mismatch: have %v, want %v", list.txs.Nonces(), want)
+	}
+	// Transactions leaving the list any other way must not stay in-flight
+	list.Ready(2, func(*types.Transaction) {})
+	list.Add(transaction(2, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	if ready := list.ReadyTentative(2); len(ready) != 1 || ready[0].Nonce() != 2 {
+		t.Errorf("re-added nonce not handed out: have %d txs", len(ready))
+	}
+}
+
+func TestTxList_ReplacementHistogram(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+
+	// Premiums: 5%, 20%, 30%, 40%, 60%, 150%
+	prices := []int64{1000, 1050, 1260, 1638, 2293, 3668, 9170}
+	for _, price := range prices {
+		list.Add(pricedTransaction(0, 100, big.NewInt(price), key), 0, nil)
+	}
+	want := []uint64{1, 1, 2, 1, 1}
+	have := list.ReplacementHistogram()
+	if len(have) != len(want) {
+		t.Fatalf("expected %d buckets but got %d", len(want), len(have))
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Errorf("bucket %d: have %d, want %d", i, have[i], want[i])
+		}
+	}
+}
+
+func TestTxList_FitsInGas(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, nonce := range []uint64{0, 1, 2, 4} {
+		list.Add(transaction(nonce, 1000, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	if fits, gas := list.FitsInGas(0, 3000); !fits || gas != 3000 {
+		t.Errorf("expected run to fit exactly, have fits=%v gas=%d", fits, gas)
+	}
+	if fits, gas := list.FitsInGas(0, 2999); fits || gas != 3000 {
+		t.Errorf("expected run not to fit, have fits=%v gas=%d", fits, gas)
+	}
+	if list.Len() != 4 {
+		t.Errorf("expected nothing to be removed, have %d txs", list.Len())
+	}
+	list.Forward(3, func(*types.Transaction) {})
+	if fits, gas := list.FitsInGas(3, 0); !fits || gas != 0 {
+		t.Errorf("expected empty run before the gap to fit, have fits=%v gas=%d", fits, gas)
+	}
+}
+
+func TestTxList_StrandedNonces(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, nonce := range []uint64{3, 4, 5, 7, 8} {
+		list.Add(transaction(nonce, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	// Every tx costs 200 wei.
+	if stranded := list.StrandedNonces(big.NewInt(1000), 3); len(stranded) != 0 {
+		t.Fatalf("expected nothing stranded with enough balance but got %v", stranded)
+	}
+	stranded := list.StrandedNonces(big.NewInt(700), 3)
+	if len(stranded) != 2 || stranded[0] != 7 || stranded[1] != 8 {
+		t.Fatalf("expected nonces [7 8] to be stranded but got %v", stranded)
+	}
+	stranded = list.StrandedNonces(big.NewInt(399), 4)
+	if len(stranded) != 3 || stranded[0] != 5 {
+		t.Errorf("expected nonces [5 7 8] to be stranded but got %v", stranded)
+	}
+}
+
+func TestTxList_CapWithScorer(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	newList := func(strict bool) *txList {
+		list := newTxList(strict)
+		for i, price := range []int64{5, 1, 4, 2, 3} {
+			list.Add(pricedTransaction(uint64(i), 100, big.NewInt(price), key), DefaultTxPoolConfig.PriceBump, nil)
+		}
+		return list
+	}
+	collect := func(list *txList, scorer EvictionScorer) []uint64 {
+		var removed []uint64
+		list.CapWithScorer(3, scorer, func(tx *types.Transaction) {
+			removed = append(removed, tx.Nonce())
+		})
+		return removed
+	}
+
+	// Built-in price scorer evicts the cheapest txs.
+	list := newList(false)
+	if removed := collect(list, EvictByPrice); len(removed) != 2 || removed[0] != 1 || removed[1] != 3 {
+		t.Fatalf("expected nonces [1 3] to be evicted by price but got %v", removed)
+	}
+	if txs := list.Flatten(); len(txs) != 3 || txs[0].Nonce() != 0 || txs[1].Nonce() != 2 || txs[2].Nonce() != 4 {
+		t.Fatalf("unexpected remaining txs %v", txs)
+	}
+
+	// Custom scorer evicting the even nonces, ties broken by higher nonce first.
+	even := EvictionScorerFunc(func(tx *types.Transaction, _ TxMeta) int64 {
+		return int64(tx.Nonce() % 2)
+	})
+	if removed := collect(newList(false), even); len(removed) != 2 || removed[0] != 4 || removed[1] != 2 {
+		t.Fatalf("expected nonces [4 2] to be evicted but got %v", removed)
+	}
+
+	// Strict lists only drop their tail.
+	if removed := collect(newList(true), EvictByPrice); len(removed) != 2 || removed[0] != 4 || removed[1] != 3 {
+		t.Errorf("expected strict list to drop its tail [4 3] but got %v", removed)
+	}
+}
+
+func TestTxList_QueuedValueBlocked(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	if value := list.QueuedValueBlocked(2, nil); value.Sign() != 0 {
+		t.Fatalf("expected nothing blocked in an empty list but got %v", value)
+	}
+	list.Add(pricedTransaction(2, 100, big.NewInt(1), key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Add(pricedTransaction(3, 100, big.NewInt(1), key), DefaultTxPoolConfig.PriceBump, nil)
+	if value := list.QueuedValueBlocked(2, nil); value.Sign() != 0 {
+		t.Fatalf("expected nothing blocked in a contiguous list but got %v", value)
+	}
+	list.Add(pricedTransaction(5, 100, big.NewInt(3), key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Add(pricedTransaction(6, 200, big.NewInt(2), key), DefaultTxPoolConfig.PriceBump, nil)
+	if value := list.QueuedValueBlocked(2, nil); value.Cmp(big.NewInt(700)) != 0 {
+		t.Errorf("expected 700 wei blocked but got %v", value)
+	}
+	// Everything is blocked if the account's next nonce is below the list
+	if value := list.QueuedValueBlocked(0, nil); value.Cmp(big.NewInt(900)) != 0 {
+		t.Errorf("expected 900 wei blocked behind a missing head but got %v", value)
+	}
+}
+
+// fakeTxClock is a txClock whose time only moves when told to.
+type fakeTxClock struct {
+	now time.Time
+}
+
+func (c *fakeTxClock) Now() time.Time { return c.now }
+
+func TestTxList_PruneOlderThan(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	clock := &fakeTxClock{now: time.Unix(1000, 0)}
+
+	list := newTxListWithClock(false, clock)
+	list.Add(transaction(0, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Add(transaction(5, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	clock.now = clock.now.Add(time.Minute)
+	list.Add(transaction(1, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	clock.now = clock.now.Add(time.Minute)
+
+	var pruned []uint64
+	list.PruneOlderThan(90*time.Second, func(tx *types.Transaction) {
+		pruned = append(pruned, tx.Nonce())
+	})
+	if len(pruned) != 2 || list.Len() != 1 {
+		t.Fatalf("expected the 2 oldest txs to be pruned, have %v pruned and %d left", pruned, list.Len())
+	}
+
+	// Strict lists invalidate everything above a pruned nonce.
+	strict := newTxListWithClock(true, clock)
+	strict.Add(transaction(0, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	strict.Add(transaction(1, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	clock.now = clock.now.Add(time.Minute)
+	strict.Add(transaction(2, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	strict.Add(pricedTransaction(1, 100, big.NewInt(2), key), DefaultTxPoolConfig.PriceBump, nil)
+
+	pruned = nil
+	strict.PruneOlderThan(30*time.Second, func(tx *types.Transaction) {
+		pruned = append(pruned, tx.Nonce())
+	})
+	if len(pruned) != 3 || !strict.Empty() {
+		t.Errorf("expected all 3 txs to be pruned from the strict list but got %v", pruned)
+	}
+}
+
+func TestTxList_Prune(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	clock := &fakeTxClock{now: time.Unix(1000, 0)}
+
+	list := newTxListWithClock(false, clock)
+	list.Add(transaction(3, 500, key), DefaultTxPoolConfig.PriceBump, nil)
+	clock.now = clock.now.Add(time.Minute)
+	list.Add(transaction(0, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Add(transaction(1, 200, key), DefaultTxPoolConfig.PriceBump, nil)
+
+	// The list clock is ignored in favour of the provided time
+	var pruned []uint64
+	list.Prune(time.Minute, time.Unix(1090, 0), func(tx *types.Transaction) {
+		pruned = append(pruned, tx.Nonce())
+	})
+	if !reflect.DeepEqual(pruned, []uint64{3}) {
+		t.Fatalf("pruned nonces mismatch: have %v, want [3]", pruned)
+	}
+	if list.gascap != 200 || list.costcap.Cmp(big.NewInt(300)) != 0 {
+		t.Errorf("caps not recomputed: have %v/%d, want 300/200", list.costcap, list.gascap)
+	}
+	if err := list.txs.invariants(); err != nil {
+		t.Errorf("inconsistent list: %v", err)
+	}
+}
+
+func TestMergeByPrice(t *testing.T) {
+	var (
+		lists []*txList
+		all   types.Transactions
+	)
+	for i := 0; i < 5; i++ {
+		key, _ := crypto.GenerateKey()
+		list := newTxList(false)
+		for j := 0; j < 20; j++ {
+			tx := pricedTransaction(uint64(j), 100, big.NewInt(rand.Int63n(50)+1), key)
+			list.Add(tx, DefaultTxPoolConfig.PriceBump, nil)
+			all = append(all, tx)
+		}
+		lists = append(lists, list)
+	}
+	lists = append(lists, newTxList(false))
+
+	merged := MergeByPrice(lists, nil)
+	if len(merged) != len(all) {
+		t.Fatalf("expected %d merged txs but got %d", len(all), len(merged))
+	}
+	seen := make(map[common.Hash]bool)
+	for i, tx := range merged {
+		if i > 0 && merged[i-1].CmpGasPriceTx(tx) < 0 {
+			t.Fatalf("tx %d: price %v above previous price %v", i, tx.GasPrice(), merged[i-1].GasPrice())
+		}
+		seen[tx.Hash()] = true
+	}
+	for _, tx := range all {
+		if !seen[tx.Hash()] {
+			t.Errorf("tx %x missing from the merged output", tx.Hash())
+		}
+	}
+}
+
+// Benchmarks the k-way price merge against concatenating the per-account lists
+// and sorting the result.
+func BenchmarkMergeByPrice(b *testing.B) {
+	lists := make([]*txList, 100)
+	for i := range lists {
+		key, _ := crypto.GenerateKey()
+		lists[i] = newTxList(false)
+		for j := 0; j < 50; j++ {
+			lists[i].Add(pricedTransaction(uint64(j), 100, big.NewInt(rand.Int63n(1000)+1), key), DefaultTxPoolConfig.PriceBump, nil)
+		}
+	}
+	// Both approaches start from cold price caches, so the merge pays for sorting
+	// each list just like the concatenation pays for the global sort
+	b.Run("merge", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, list := range lists {
+				list.InvalidatePriceCache()
+			}
+			MergeByPrice(lists, nil)
+		}
+	})
+	b.Run("merge-cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			MergeByPrice(lists, nil)
+		}
+	})
+	b.Run("concat-sort", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var txs types.Transactions
+			for _, list := range lists {
+				txs = append(txs, list.FlattenView()...)
+			}
+			sort.SliceStable(txs, func(i, j int) bool {
+				return txs[i].CmpGasPriceTx(txs[j]) > 0
+			})
+		}
+	})
+}
+
+func TestTxList_KeepHigherGasOnTie(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	low := pricedTransaction(0, 100, big.NewInt(100), key)
+	high := pricedTransaction(0, 200, big.NewInt(105), key)
+
+	list := newTxList(false)
+	list.Add(low, DefaultTxPoolConfig.PriceBump, nil)
+	if ok, _ := list.Add(high, DefaultTxPoolConfig.PriceBump, nil); ok {
+		t.Fatalf("expected default policy to reject a replacement within the bump")
+	}
+
+	list.SetReplacementPolicy(KeepHigherGasOnTie)
+	if ok, old := list.Add(high, DefaultTxPoolConfig.PriceBump, nil); !ok || old != low {
+		t.Fatalf("expected higher gas tx to win the tie")
+	}
+	if ok, _ := list.Add(low, DefaultTxPoolConfig.PriceBump, nil); ok {
+		t.Fatalf("expected lower gas tx to lose the tie")
+	}
+	// Transactions clearing the bump still win regardless of gas.
+	bumped := pricedTransaction(0, 50, big.NewInt(200), key)
+	if ok, _ := list.Add(bumped, DefaultTxPoolConfig.PriceBump, nil); !ok {
+		t.Errorf("expected a properly bumped tx to be accepted")
+	}
+}
+
+func TestTxList_BlockFillRatio(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, nonce := range []uint64{0, 1, 3} {
+		list.Add(transaction(nonce, 25000, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	if ratio := list.BlockFillRatio(0, 100000); ratio != 0.5 {
+		t.Errorf("expected ratio 0.5 but got %v", ratio)
+	}
+	if ratio := list.BlockFillRatio(0, 40000); ratio != 1 {
+		t.Errorf("expected ratio to be clamped to 1 but got %v", ratio)
+	}
+}
+
+func TestTxList_MarshalHistory(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	list.TrackHistory()
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		list.Add(pricedTransaction(nonce, 100, big.NewInt(1), key), DefaultTxPoolConfig.PriceBump, nil)
+		list.Add(pricedTransaction(nonce, 100, big.NewInt(2), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	blob, err := list.MarshalHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nonce 0 got mined between shutdown and restart.
+	restored := newTxList(false)
+	if err := restored.UnmarshalHistory(blob, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored.history[0]; ok {
+		t.Errorf("expected stale history of nonce 0 to be pruned")
+	}
+	for nonce := uint64(1); nonce < 3; nonce++ {
+		have, want := restored.history[nonce], list.history[nonce]
+		if len(have) != len(want) {
+			t.Fatalf("nonce %d: history length mismatch: have %d, want %d", nonce, len(have), len(want))
+		}
+		for i := range want {
+			if have[i].Hash != want[i].Hash || !have[i].sameIntent(want[i]) {
+				t.Errorf("nonce %d entry %d: have %x, want %x", nonce, i, have[i].Hash, want[i].Hash)
+			}
+		}
+	}
+	// Entries without a value are rejected instead of tripping conflict checks
+	for _, blob := range []string{`{"1":[{"hash":"0x0000000000000000000000000000000000000000000000000000000000000000","to":null}]}`, `{"1":[{"hash":"0x0000000000000000000000000000000000000000000000000000000000000000","to":null,"value":null}]}`} {
+		corrupt := newTxList(false)
+		if err := corrupt.UnmarshalHistory([]byte(blob), 0); err == nil {
+			t.Errorf("expected history %s to be rejected", blob)
+		}
+		if corrupt.history != nil {
+			t.Errorf("rejected history %s partially restored", blob)
+		}
+	}
+	// Empty histories are dropped and overlong ones truncated to the limit
+	var entries []string
+	for i := 0; i < txListHistoryLimit+3; i++ {
+		entries = append(entries, fmt.Sprintf(`{"hash":"0x%064x","to":null,"value":%d}`, i, i))
+	}
+	blob = []byte(`{"5":[],"6":[` + strings.Join(entries, ",") + `]}`)
+	restored = newTxList(false)
+	if err := restored.UnmarshalHistory(blob, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored.history[5]; ok {
+		t.Errorf("expected the empty history to be dropped")
+	}
+	if hist := restored.history[6]; len(hist) != txListHistoryLimit || hist[0].Value.Int64() != 3 {
+		t.Errorf("expected the newest %d entries to be kept, have %d", txListHistoryLimit, len(hist))
+	}
+	restored.history[7] = nil
+	if conflicts := restored.ConflictingNonces(); len(conflicts) != 1 || conflicts[0] != 6 {
+		t.Errorf("conflict mismatch: have %v, want [6]", conflicts)
+	}
+}
+
+func TestTxList_ApplyReorg(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for nonce := uint64(5); nonce < 8; nonce++ {
+		list.Add(transaction(nonce, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	list.Flatten()
+
+	// The new chain mined nonces up to 5, and the txs 6-9 of the old chain need to
+	// be reinjected: 6 and 7 are already pooled, 8 and 9 are new and 4 is stale.
+	reinject := types.Transactions{
+		transaction(4, 100, key),
+		transaction(6, 100, key),
+		pricedTransaction(7, 100, big.NewInt(2), key),
+		transaction(8, 100, key),
+		transaction(9, 100, key),
+	}
+	var forwarded []uint64
+	accepted, rejected := list.ApplyReorg(6, reinject, DefaultTxPoolConfig.PriceBump, func(tx *types.Transaction) {
+		forwarded = append(forwarded, tx.Nonce())
+	})
+	if len(forwarded) != 1 || forwarded[0] != 5 {
+		t.Fatalf("expected nonce 5 to be forwarded but got %v", forwarded)
+	}
+	if len(accepted) != 3 || len(rejected) != 2 {
+		t.Fatalf("expected 3 accepted and 2 rejected txs, have %d and %d", len(accepted), len(rejected))
+	}
+	txs := list.Flatten()
+	if len(txs) != 4 {
+		t.Fatalf("expected 4 txs in the list but got %d", len(txs))
+	}
+	for i, tx := range txs {
+		if tx.Nonce() != uint64(6+i) {
+			t.Errorf("position %d: expected nonce %d but got %d", i, 6+i, tx.Nonce())
+		}
+	}
+	if txs[1] != reinject[2] {
+		t.Errorf("expected the higher priced reinjected tx to replace nonce 7")
+	}
+	var ready int
+	list.Ready(6, func(*types.Transaction) { ready++ })
+	if ready != 4 || !list.Empty() {
+		t.Errorf("expected heap to be consistent after the reorg, %d ready and %d left", ready, list.Len())
+	}
+}
+
+func TestTxList_WhatIf(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, nonce := range []uint64{3, 4, 6, 7, 8} {
+		list.Add(transaction(nonce, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	tests := []struct {
+		base            uint64
+		pending, queued int
+	}{
+		{2, 0, 5},
+		{3, 2, 3},
+		{4, 1, 3},
+		{5, 0, 3},
+		{6, 3, 0},
+		{9, 0, 0},
+	}
+	for _, tt := range tests {
+		pending, queued := list.WhatIf(tt.base)
+		if len(pending) != tt.pending || len(queued) != tt.queued {
+			t.Errorf("base %d: expected %d pending and %d queued, have %d and %d", tt.base, tt.pending, tt.queued, len(pending), len(queued))
+		}
+		if len(pending) > 0 && pending[0].Nonce() != tt.base {
+			t.Errorf("base %d: expected pending to start at the base but got %d", tt.base, pending[0].Nonce())
+		}
+	}
+	if list.Len() != 5 {
+		t.Errorf("expected the list to be untouched, have %d txs", list.Len())
+	}
+}
+
+func TestTxList_ConflictingNonces(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	list.TrackHistory()
+
+	// Nonce 0 only sees fee bumps.
+	list.Add(pricedTransaction(0, 100, big.NewInt(1), key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Add(pricedTransaction(0, 100, big.NewInt(2), key), DefaultTxPoolConfig.PriceBump, nil)
+
+	// Nonce 1 sees a transfer to a different recipient.
+	list.Add(pricedTransaction(1, 100, big.NewInt(1), key), DefaultTxPoolConfig.PriceBump, nil)
+	other, _ := types.SignTx(types.NewTransaction(1, common.Address{0x01}, big.NewInt(100), 100, big.NewInt(2), nil), types.HomesteadSigner{}, key)
+	list.Add(other, DefaultTxPoolConfig.PriceBump, nil)
+
+	// Nonce 2 sees a different value.
+	list.Add(pricedTransaction(2, 100, big.NewInt(1), key), DefaultTxPoolConfig.PriceBump, nil)
+	more, _ := types.SignTx(types.NewTransaction(2, common.Address{}, big.NewInt(1000), 100, big.NewInt(2), nil), types.HomesteadSigner{}, key)
+	list.Add(more, DefaultTxPoolConfig.PriceBump, nil)
+
+	conflicts := list.ConflictingNonces()
+	if len(conflicts) != 2 || conflicts[0] != 1 || conflicts[1] != 2 {
+		t.Errorf("expected nonces [1 2] to be conflicting but got %v", conflicts)
+	}
+}
+
+func TestTxList_CapBytesSaved(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for i := 0; i < 10; i++ {
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), common.Address{}, big.NewInt(100), 100000, big.NewInt(1), make([]byte, i*10)), types.HomesteadSigner{}, key)
+		list.Add(tx, DefaultTxPoolConfig.PriceBump, nil)
+	}
+	if saved := list.CapBytesSaved(10); saved != 0 {
+		t.Fatalf("expected nothing saved under the limit but got %d", saved)
+	}
+	saved := list.CapBytesSaved(4)
+
+	var freed uint64
+	list.Cap(4, func(tx *types.Transaction) {
+		freed += uint64(tx.Size())
+	})
+	if saved == 0 || saved != freed {
+		t.Errorf("expected %d bytes saved but got %d", freed, saved)
+	}
+	// The estimate must follow the eviction order of priorities and fee protection
+	list = newTxList(false)
+	list.ProtectTopFee = true
+	for i := 0; i < 6; i++ {
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), common.Address{}, big.NewInt(100), 100000, big.NewInt(int64(1+i%3)), make([]byte, i*10)), types.HomesteadSigner{}, key)
+		list.txs.PutPriority(tx, uint8(i%2))
+	}
+	saved = list.CapBytesSaved(2)
+	if list.Len() != 6 {
+		t.Fatalf("estimate modified the list")
+	}
+	freed = 0
+	list.Cap(2, func(tx *types.Transaction) {
+		freed += uint64(tx.Size())
+	})
+	if saved != freed {
+		t.Errorf("expected %d bytes saved with priorities but got %d", freed, saved)
+	}
+	// Every eviction strategy must be previewed exactly
+	for _, strict := range []bool{false, true} {
+		for _, protect := range []bool{false, true} {
+			for _, prioritize := range []bool{false, true} {
+				list = newTxList(strict)
+				list.ProtectTopFee = protect
+				for i := 0; i < 8; i++ {
+					tx, _ := types.SignTx(types.NewTransaction(uint64(i), common.Address{}, big.NewInt(100), 100000, big.NewInt(int64(1+(i*5)%7)), make([]byte, i*10)), types.HomesteadSigner{}, key)
+					if prioritize {
+						list.txs.PutPriority(tx, uint8(i%3))
+					} else {
+						list.txs.Put(tx)
+					}
+				}
+				saved = list.CapBytesSaved(3)
+				freed = 0
+				list.Cap(3, func(tx *types.Transaction) {
+					freed += uint64(tx.Size())
+				})
+				if saved != freed {
+					t.Errorf("strict %v, protect %v, priorities %v: expected %d bytes saved but got %d", strict, protect, prioritize, freed, saved)
+				}
+			}
+		}
+	}
+}
+
+func TestTxList_OriginAwarePolicy(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	owner, thirdParty := common.Address{0x01}, common.Address{0x02}
+
+	list := newTxList(false)
+	list.SetReplacementPolicy(OriginAwarePolicy{CrossOriginBump: 50})
+	list.AddWith(pricedTransaction(0, 100, big.NewInt(100), key), txAddOpts{sender: &owner})
+	list.AddWith(pricedTransaction(1, 100, big.NewInt(100), key), txAddOpts{sender: &owner})
+
+	// A 20% bump is enough for the same origin...
+	if ok, _, _ := list.AddWith(pricedTransaction(0, 100, big.NewInt(120), key), txAddOpts{priceBump: 10, sender: &owner}); !ok {
+		t.Fatalf("expected same origin replacement with a 20%% bump to be accepted")
+	}
+	// ...but not for a different one, which needs 50%.
+	if ok, _, reason := list.AddWith(pricedTransaction(1, 100, big.NewInt(120), key), txAddOpts{priceBump: 10, sender: &thirdParty}); ok || reason != RejectedUnderpriced {
+		t.Fatalf("expected cross origin replacement with a 20%% bump to be rejected")
+	}
+	if ok, _, _ := list.AddWith(pricedTransaction(1, 100, big.NewInt(150), key), txAddOpts{priceBump: 10, sender: &thirdParty}); !ok {
+		t.Fatalf("expected cross origin replacement with a 50%% bump to be accepted")
+	}
+	// The third party now owns nonce 1.
+	if ok, _, _ := list.AddWith(pricedTransaction(1, 100, big.NewInt(180), key), txAddOpts{priceBump: 10, sender: &owner}); ok {
+		t.Errorf("expected the original owner to need the cross origin bump")
+	}
+}
+
+func TestTxList_Page(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, i := range rand.Perm(1000) {
+		list.Add(transaction(uint64(i), 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	var next uint64
+	for offset := 0; ; offset += 64 {
+		page := list.Page(offset, 64)
+		if len(page) == 0 {
+			break
+		}
+		for _, tx := range page {
+			if tx.Nonce() != next {
+				t.Fatalf("offset %d: expected nonce %d but got %d", offset, next, tx.Nonce())
+			}
+			next++
+		}
+	}
+	if next != 1000 {
+		t.Errorf("expected to page through 1000 txs but got %d", next)
+	}
+	if page := list.Page(1000, 10); page == nil || len(page) != 0 {
+		t.Errorf("expected an empty page past the end but got %v", page)
+	}
+}
+
+func TestTxList_BaseFeeDelta(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(true)
+	for i, price := range []int64{30, 20, 25, 10} {
+		list.Add(pricedTransaction(uint64(i), 100, big.NewInt(price), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	nonces := func(txs types.Transactions) []uint64 {
+		ns := []uint64{}
+		for _, tx := range txs {
+			ns = append(ns, tx.Nonce())
+		}
+		return ns
+	}
+
+	// Raising the fee over 20 stalls nonce 1 and everything after it.
+	stuck, freed := list.BaseFeeDelta(big.NewInt(10), big.NewInt(21), 0)
+	if n := nonces(stuck); len(n) != 3 || n[0] != 1 || len(freed) != 0 {
+		t.Fatalf("expected nonces [1 2 3] to get stuck but got %v, freed %v", n, nonces(freed))
+	}
+	// Lowering it back frees them again.
+	stuck, freed = list.BaseFeeDelta(big.NewInt(21), big.NewInt(15), 0)
+	if n := nonces(freed); len(n) != 2 || n[0] != 1 || n[1] != 2 || len(stuck) != 0 {
+		t.Fatalf("expected nonces [1 2] to be freed but got %v, stuck %v", n, nonces(stuck))
+	}
+	// Changes not crossing any fee cap are no-ops.
+	if stuck, freed = list.BaseFeeDelta(big.NewInt(11), big.NewInt(19), 0); len(stuck) != 0 || len(freed) != 0 {
+		t.Errorf("expected no transitions but got stuck %v, freed %v", nonces(stuck), nonces(freed))
+	}
+}
+
+func TestTxList_ExpectedSender(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	owner, other := crypto.PubkeyToAddress(key.PublicKey), common.Address{0x01}
+
+	list := newTxListForSender(false, owner)
+	if ok, _, reason := list.AddWith(transaction(0, 100, key), txAddOpts{sender: &other}); ok || reason != RejectedWrongSender {
+		t.Fatalf("expected misrouted tx to be rejected, have accepted=%v reason=%d", ok, reason)
+	}
+	if ok, _, _ := list.AddWith(transaction(0, 100, key), txAddOpts{sender: &owner}); !ok {
+		t.Fatalf("expected tx from the expected sender to be accepted")
+	}
+	if ok := list.Overlaps(transaction(0, 100, key)); !ok {
+		t.Errorf("expected the accepted tx to be stored")
+	}
+
+	// Lists without an expected sender don't check anything.
+	unchecked := newTxList(false)
+	if ok, _, _ := unchecked.AddWith(transaction(0, 100, key), txAddOpts{sender: &other}); !ok {
+		t.Errorf("expected unchecked list to accept any sender")
+	}
+}
+
+func TestTxList_Stuckness(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	clock := &fakeTxClock{now: time.Unix(1000, 0)}
+
+	healthy := newTxListWithClock(true, clock)
+	stuck := newTxListWithClock(false, clock)
+	for nonce := uint64(0); nonce < 4; nonce++ {
+		healthy.Add(transaction(nonce, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	for _, nonce := range []uint64{2, 3, 7, 12} {
+		stuck.Add(pricedTransaction(nonce, 1000000, big.NewInt(1e12), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	clock.now = clock.now.Add(time.Hour)
+
+	if score := healthy.Stuckness(0, nil); score != 0 {
+		t.Errorf("expected healthy list to score 0 but got %v", score)
+	}
+	score := stuck.Stuckness(0, nil)
+	if score < 0.7 || score > 1 {
+		t.Errorf("expected stuck list to score high but got %v", score)
+	}
+
+	// Only weighing the gaps: 3 gaps score 3/4.
+	stuck.SetStucknessWeights(&StucknessWeights{Gaps: 1})
+	if score := stuck.Stuckness(0, nil); score != 0.75 {
+		t.Errorf("expected gap only score 0.75 but got %v", score)
+	}
+	// A missing value scale saturates like a zero age scale does
+	stuck.SetStucknessWeights(&StucknessWeights{Value: 1})
+	if score := stuck.Stuckness(0, nil); score != 1 {
+		t.Errorf("expected unscaled value score 1 but got %v", score)
+	}
+}
+
+func TestTxSortedMap_Range(t *testing.T) {
+	txSortedMap := newTxSortedMap()
+
+	key, _ := crypto.GenerateKey()
+	for _, nonce := range []uint64{1, 2, 4, 5, 6, 9} {
+		txSortedMap.Put(transaction(nonce, 0, key))
+	}
+	var visited []uint64
+	txSortedMap.Range(2, 9, func(tx *types.Transaction) bool {
+		visited = append(visited, tx.Nonce())
+		return true
+	})
+	if len(visited) != 4 || visited[0] != 2 || visited[3] != 6 {
+		t.Fatalf("expected nonces [2 4 5 6] but got %v", visited)
+	}
+
+	visited = nil
+	txSortedMap.Range(0, 100, func(tx *types.Transaction) bool {
+		visited = append(visited, tx.Nonce())
+		return len(visited) < 2
+	})
+	if len(visited) != 2 {
+		t.Fatalf("expected early termination after 2 txs but got %v", visited)
+	}
+	if txSortedMap.cache == nil || txSortedMap.Len() != 6 {
+		t.Errorf("expected the cache and contents to be left intact")
+	}
+}
+
+func TestTxList_GapFrom(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	if nonce, gapped := list.GapFrom(3); nonce != 3 || gapped {
+		t.Fatalf("expected no gap in an empty list, have %d/%v", nonce, gapped)
+	}
+	for _, nonce := range []uint64{3, 4, 5} {
+		list.Add(transaction(nonce, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	if nonce, gapped := list.GapFrom(3); nonce != 6 || gapped {
+		t.Fatalf("expected no gap in a contiguous list, have %d/%v", nonce, gapped)
+	}
+	list.Add(transaction(8, 100, key), DefaultTxPoolConfig.PriceBump, nil)
+	if nonce, gapped := list.GapFrom(3); nonce != 6 || !gapped {
+		t.Fatalf("expected gap at 6, have %d/%v", nonce, gapped)
+	}
+	if nonce, gapped := list.GapFrom(2); nonce != 2 || !gapped {
+		t.Errorf("expected gap at 2, have %d/%v", nonce, gapped)
+	}
+}
+
+// Tests that an absolute minimum bump is enforced on top of the percentage
+// threshold for low priced replacements.
+func TestTxList_MinBump(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+
+	old := pricedTransaction(0, 21000, big.NewInt(5), key)
+	list.Add(old, 10, nil)
+
+	// 10% of 5 wei rounds down, so 6 wei passes the percentage check alone
+	if ok, _ := list.Add(pricedTransaction(0, 21000, big.NewInt(6), key), 10, big.NewInt(2)); ok {
+		t.Fatalf("replacement below minimum bump accepted")
+	}
+	if ok, _ := list.Add(pricedTransaction(0, 21000, big.NewInt(7), key), 10, big.NewInt(2)); !ok {
+		t.Fatalf("replacement at minimum bump rejected")
+	}
+	if ok, _ := list.Add(pricedTransaction(0, 21000, big.NewInt(8), key), 10, nil); !ok {
+		t.Fatalf("replacement without minimum bump rejected")
+	}
+}
+
+func TestTxList_TruncateAtGap(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, nonce := range []uint64{0, 1, 2, 3} {
+		list.Add(transaction(nonce, 0, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	list.TruncateAtGap(0, func(tx *types.Transaction) {
+		t.Fatalf("unexpected removal of nonce %d without a gap", tx.Nonce())
+	})
+	for _, nonce := range []uint64{5, 7, 6} {
+		list.Add(transaction(nonce, 0, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	var removed []uint64
+	list.TruncateAtGap(1, func(tx *types.Transaction) {
+		removed = append(removed, tx.Nonce())
+	})
+	if len(removed) != 3 || removed[0] != 5 || removed[1] != 6 || removed[2] != 7 {
+		t.Fatalf("expected nonces [5 6 7] to be removed, have %v", removed)
+	}
+	if list.Len() != 4 || list.txs.index.Len() != 4 {
+		t.Errorf("expected the contiguous prefix of 4 txs to remain, have %d", list.Len())
+	}
+}
+
+func TestTxList_FilterByGasPrice(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	prices := []int64{5, 3, 5, 8}
+	gases := []uint64{100, 500, 200, 100}
+
+	for _, strict := range []bool{false, true} {
+		list := newTxList(strict)
+		for i, price := range prices {
+			list.Add(pricedTransaction(uint64(i), gases[i], big.NewInt(price), key), DefaultTxPoolConfig.PriceBump, nil)
+		}
+		list.FilterByGasPrice(big.NewInt(3), func(tx *types.Transaction) {
+			t.Fatalf("strict %v: unexpected removal of nonce %d", strict, tx.Nonce())
+		}, nil)
+
+		var removed, invalid []uint64
+		list.FilterByGasPrice(big.NewInt(4), func(tx *types.Transaction) {
+			removed = append(removed, tx.Nonce())
+		}, func(tx *types.Transaction) {
+			invalid = append(invalid, tx.Nonce())
+		})
+		if len(removed) != 1 || removed[0] != 1 {
+			t.Fatalf("strict %v: expected nonce 1 to be removed, have %v", strict, removed)
+		}
+		want, gascap := 3, uint64(200)
+		if strict {
+			want, gascap = 1, 100
+			if len(invalid) != 2 {
+				t.Fatalf("strict %v: expected 2 invalidated txs, have %v", strict, invalid)
+			}
+		}
+		if list.Len() != want {
+			t.Fatalf("strict %v: expected %d txs left, have %d", strict, want, list.Len())
+		}
+		if list.gascap != gascap {
+			t.Errorf("strict %v: expected gas cap %d, have %d", strict, gascap, list.gascap)
+		}
+	}
+}
+
+func TestTxList_AddBatch(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	list.Add(pricedTransaction(0, 100, big.NewInt(10), key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Add(pricedTransaction(1, 100, big.NewInt(10), key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Flatten()
+
+	batch := types.Transactions{
+		pricedTransaction(3, 100, big.NewInt(10), key),
+		pricedTransaction(0, 100, big.NewInt(20), key), // outbids the stored tx
+		pricedTransaction(1, 100, big.NewInt(10), key), // underpriced replacement
+		pricedTransaction(2, 300, big.NewInt(10), key),
+		pricedTransaction(2, 100, big.NewInt(10), key), // underpriced replacement within the batch
+	}
+	added, replaced := list.AddBatch(batch, DefaultTxPoolConfig.PriceBump)
+	if added != 3 {
+		t.Fatalf("expected 3 txs to be added, have %d", added)
+	}
+	if len(replaced) != 1 || replaced[0].Nonce() != 0 || replaced[0].GasPrice().Int64() != 10 {
+		t.Fatalf("expected the original nonce 0 tx to be replaced, have %v", replaced)
+	}
+	for i, tx := range list.Flatten() {
+		if tx.Nonce() != uint64(i) {
+			t.Fatalf("tx %d: expected nonce %d but got %d", i, i, tx.Nonce())
+		}
+	}
+	if list.Len() != 4 || list.gascap != 300 {
+		t.Errorf("expected 4 txs with a gas cap of 300, have %d txs and cap %d", list.Len(), list.gascap)
+	}
+}
+
+// Tests that batch insertions bound the nonce gap against the transactions of the
+// batch admitted so far, just like sequential adds do.
+func TestTxList_AddBatchMaxNonceGap(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	list.SetMaxNonceGap(2)
+
+	batch := make(types.Transactions, 6)
+	for i := range batch {
+		batch[i] = transaction(uint64(i), 0, key)
+	}
+	if added, _ := list.AddBatch(batch, DefaultTxPoolConfig.PriceBump); added != len(batch) {
+		t.Fatalf("expected all %d txs to be added, have %d", len(batch), added)
+	}
+	if err := list.txs.invariants(); err != nil {
+		t.Errorf("inconsistent list: %v", err)
+	}
+}
+
+func TestTxList_Has(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, nonce := range []uint64{1, 3} {
+		list.Add(transaction(nonce, 0, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	for nonce, want := range map[uint64]bool{0: false, 1: true, 2: false, 3: true, 4: false} {
+		if have := list.Has(nonce); have != want {
+			t.Errorf("nonce %d: expected presence %v, have %v", nonce, want, have)
+		}
+	}
+	list.Remove(list.txs.Get(3), nil)
+	if list.Has(3) {
+		t.Errorf("expected nonce 3 to be gone after removal")
+	}
+}
+
+func TestTxList_SetStrict(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, nonce := range []uint64{3, 4, 6, 7} {
+		list.Add(transaction(nonce, 0, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	dropped := list.SetStrict(true, 3)
+	if !list.strict {
+		t.Fatalf("expected the list to be strict")
+	}
+	if len(dropped) != 2 || dropped[0].Nonce() != 6 || dropped[1].Nonce() != 7 {
+		t.Fatalf("expected nonces 6 and 7 to be dropped, have %v", dropped)
+	}
+	if list.Len() != 2 {
+		t.Fatalf("expected 2 txs left, have %d", list.Len())
+	}
+	// Strict mode now invalidates higher nonces on removal
+	var invalid int
+	list.Remove(list.txs.Get(3), func(*types.Transaction) { invalid++ })
+	if invalid != 1 || !list.Empty() {
+		t.Fatalf("expected the removal to invalidate nonce 4, have %d invalidated and %d left", invalid, list.Len())
+	}
+	if dropped := list.SetStrict(false, 0); dropped != nil || list.strict {
+		t.Errorf("expected switching back to drop nothing, have %v", dropped)
+	}
+}
+
+func TestTxList_PopReady(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, nonce := range []uint64{3, 4, 5, 7} {
+		list.Add(transaction(nonce, 0, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	if ready := list.PopReady(2); ready == nil || len(ready) != 0 {
+		t.Fatalf("expected an empty slice when nothing is ready, have %v", ready)
+	}
+	ready := list.PopReady(3)
+	if len(ready) != 3 || cap(ready) != 3 {
+		t.Fatalf("expected 3 ready txs in an exactly sized slice, have %d (cap %d)", len(ready), cap(ready))
+	}
+	for i, tx := range ready {
+		if want := uint64(3 + i); tx.Nonce() != want {
+			t.Errorf("tx %d: expected nonce %d but got %d", i, want, tx.Nonce())
+		}
+	}
+	if list.Len() != 1 || !list.Has(7) {
+		t.Errorf("expected only nonce 7 to remain, have %d txs", list.Len())
+	}
+}
+
+func TestTxList_OldestSeen(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	clock := &fakeTxClock{now: time.Unix(1000, 0)}
+	list := newTxListWithClock(false, clock)
+	if seen := list.OldestSeen(); !seen.IsZero() {
+		t.Fatalf("expected the zero time for an empty list, have %v", seen)
+	}
+	for _, nonce := range []uint64{2, 0, 1} {
+		list.Add(transaction(nonce, 0, key), DefaultTxPoolConfig.PriceBump, nil)
+		clock.now = clock.now.Add(time.Minute)
+	}
+	if seen := list.OldestSeen(); !seen.Equal(time.Unix(1000, 0)) {
+		t.Fatalf("expected the first insertion time, have %v", seen)
+	}
+	list.Remove(list.txs.Get(2), nil)
+	if seen := list.OldestSeen(); !seen.Equal(time.Unix(1060, 0)) {
+		t.Fatalf("expected the second insertion time after a removal, have %v", seen)
+	}
+	list.Forward(1, func(*types.Transaction) {})
+	if seen := list.OldestSeen(); !seen.Equal(time.Unix(1120, 0)) {
+		t.Errorf("expected the third insertion time after forwarding, have %v", seen)
+	}
+}
+
+func TestTxList_Merge(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	clock := &fakeTxClock{now: time.Unix(1000, 0)}
+	pending, queued := newTxListWithClock(true, clock), newTxListWithClock(false, clock)
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		pending.Add(pricedTransaction(nonce, 100, big.NewInt(10), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	queued.Add(pricedTransaction(1, 100, big.NewInt(20), key), DefaultTxPoolConfig.PriceBump, nil)
+	queued.Add(pricedTransaction(2, 100, big.NewInt(10), key), DefaultTxPoolConfig.PriceBump, nil)
+	queued.Add(pricedTransaction(3, 100, big.NewInt(10), key), DefaultTxPoolConfig.PriceBump, nil)
+	clock.now = clock.now.Add(time.Minute)
+
+	displaced := pending.Merge(queued, DefaultTxPoolConfig.PriceBump)
+	if len(displaced) != 2 {
+		t.Fatalf("expected 2 displaced txs, have %d", len(displaced))
+	}
+	if displaced[0].Nonce() != 1 || displaced[0].GasPrice().Int64() != 10 {
+		t.Errorf("expected the outbid nonce 1 tx to be displaced first, have %v", displaced[0])
+	}
+	if displaced[1].Nonce() != 2 || displaced[1] == pending.txs.Get(2) {
+		t.Errorf("expected the underpriced nonce 2 tx to be displaced, have %v", displaced[1])
+	}
+	if pending.Len() != 4 || !queued.Empty() {
+		t.Fatalf("expected 4 merged txs and a drained source, have %d and %d", pending.Len(), queued.Len())
+	}
+	if arrival := pending.txs.meta(3).Arrival; !arrival.Equal(time.Unix(1060, 0)) {
+		t.Errorf("expected the arrival time to be preserved, have %v", arrival)
+	}
+	// Merging a list into itself must leave it intact
+	if displaced := pending.Merge(pending, DefaultTxPoolConfig.PriceBump); len(displaced) != 0 || pending.Empty() {
+		t.Errorf("self merge displaced %d txs, %d left", len(displaced), pending.Len())
+	}
+}
+
+func TestTxListCap(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxListCap(true, 64)
+	if c := cap(list.txs.index.Values); c != 64 {
+		t.Fatalf("expected a heap capacity of 64, have %d", c)
+	}
+	for _, i := range rand.Perm(64) {
+		list.Add(transaction(uint64(i), 0, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	if c := cap(list.txs.index.Values); c != 64 {
+		t.Errorf("expected the heap not to grow, have capacity %d", c)
+	}
+	if err := list.txs.invariants(); err != nil {
+		t.Errorf("inconsistent map: %v", err)
+	}
+}
+
+func TestTxList_Recompute(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for i, gas := range []uint64{100, 500, 200} {
+		list.Add(transaction(uint64(i), gas, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	list.Remove(list.txs.Get(1), nil)
+	if list.gascap != 500 || list.costcap.Uint64() != 600 {
+		t.Fatalf("expected stale caps of 500 gas and 600 cost, have %d and %v", list.gascap, list.costcap)
+	}
+	list.Recompute()
+	if list.gascap != 200 || list.costcap.Uint64() != 300 {
+		t.Fatalf("expected exact caps of 200 gas and 300 cost, have %d and %v", list.gascap, list.costcap)
+	}
+	list.Forward(3, func(*types.Transaction) {})
+	list.Recompute()
+	if list.gascap != 0 || list.costcap.Sign() != 0 {
+		t.Errorf("expected zero caps for an empty list, have %d and %v", list.gascap, list.costcap)
+	}
+}
+
+func TestTxList_Executable(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, nonce := range []uint64{3, 4, 5, 7} {
+		list.Add(transaction(nonce, 0, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	for start, want := range map[uint64]int{2: 0, 3: 3, 4: 3, 7: 3} {
+		if have := list.Executable(start); have != want {
+			t.Errorf("start %d: expected %d executable txs, have %d", start, want, have)
+		}
+	}
+	if list.Len() != 4 {
+		t.Fatalf("expected nothing to be removed, have %d txs", list.Len())
+	}
+	if have, ready := list.Executable(3), list.PopReady(3); have != len(ready) {
+		t.Errorf("expected the preview to match Ready, have %d and %d", have, len(ready))
+	}
+}
+
+func TestTxList_CapCost(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for i, gas := range []uint64{400, 100, 200, 500} {
+		list.Add(transaction(uint64(i), gas, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	// Costs are gas + 100 value at a gas price of 1: 500, 200, 300, 600
+	list.CapCost(big.NewInt(1600), func(tx *types.Transaction) {
+		t.Fatalf("unexpected removal of nonce %d under the limit", tx.Nonce())
+	})
+	var removed []uint64
+	list.CapCost(big.NewInt(999), func(tx *types.Transaction) {
+		removed = append(removed, tx.Nonce())
+	})
+	if len(removed) != 2 || list.Len() != 2 {
+		t.Fatalf("expected nonces 2 and 3 to be removed, have %v", removed)
+	}
+	if list.gascap != 400 || list.TotalCost().Uint64() != 700 {
+		t.Fatalf("expected a gas cap of 400 and a total cost of 700, have %d and %v", list.gascap, list.TotalCost())
+	}
+	list.CapCost(big.NewInt(100), func(*types.Transaction) {})
+	if !list.Empty() || list.costcap.Sign() != 0 {
+		t.Errorf("expected a too costly first tx to empty the list, have %d txs", list.Len())
+	}
+}
+
+func TestTxList_GasPriceStats(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	if min, median, max := list.GasPriceStats(); min != nil || median != nil || max != nil {
+		t.Fatalf("expected nil stats for an empty list, have %v, %v and %v", min, median, max)
+	}
+	for i, price := range []int64{7, 1, 4} {
+		list.Add(pricedTransaction(uint64(i), 0, big.NewInt(price), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	if min, median, max := list.GasPriceStats(); min.Int64() != 1 || median.Int64() != 4 || max.Int64() != 7 {
+		t.Fatalf("expected stats 1, 4 and 7, have %v, %v and %v", min, median, max)
+	}
+	list.Add(pricedTransaction(3, 0, big.NewInt(10), key), DefaultTxPoolConfig.PriceBump, nil)
+	if min, median, max := list.GasPriceStats(); min.Int64() != 1 || median.Int64() != 5 || max.Int64() != 10 {
+		t.Errorf("expected stats 1, 5 and 10, have %v, %v and %v", min, median, max)
+	}
+}
+
+func TestTxList_ReplacementCount(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(true)
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		list.Add(pricedTransaction(nonce, 0, big.NewInt(1), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	for price := int64(2); price < 6; price++ {
+		list.Add(pricedTransaction(1, 0, big.NewInt(price), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	list.Add(pricedTransaction(2, 0, big.NewInt(1), key), DefaultTxPoolConfig.PriceBump, nil)
+	list.Add(pricedTransaction(0, 0, big.NewInt(2), key), DefaultTxPoolConfig.PriceBump, nil)
+
+	for nonce, want := range map[uint64]int{0: 1, 1: 4, 2: 0} {
+		if have := list.ReplacementCount(nonce); have != want {
+			t.Errorf("nonce %d: expected %d replacements, have %d", nonce, want, have)
+		}
+	}
+	list.Forward(1, func(*types.Transaction) {})
+	list.Remove(list.txs.Get(1), func(*types.Transaction) {})
+	if len(list.replaced) != 0 {
+		t.Errorf("expected the counts of dropped nonces to be cleaned up, have %v", list.replaced)
+	}
+	// Every other removal path must clean up the counts as well
+	noop := func(*types.Transaction) {}
+	drops := map[string]func(*txList){
+		"cap":    func(l *txList) { l.Cap(0, noop) },
+		"filter": func(l *txList) { l.Filter(big.NewInt(0), 0, noop, noop) },
+		"ready":  func(l *txList) { l.Ready(0, noop) },
+		"afford": func(l *txList) { l.FilterAffordable(big.NewInt(0), 0, noop) },
+	}
+	for name, drop := range drops {
+		list := newTxList(false)
+		list.Add(pricedTransaction(0, 0, big.NewInt(1), key), DefaultTxPoolConfig.PriceBump, nil)
+		list.Add(pricedTransaction(0, 0, big.NewInt(2), key), DefaultTxPoolConfig.PriceBump, nil)
+		drop(list)
+		list.Add(pricedTransaction(0, 0, big.NewInt(3), key), DefaultTxPoolConfig.PriceBump, nil)
+		if have := list.ReplacementCount(0); have != 0 {
+			t.Errorf("%s: reused nonce inherited %d replacements", name, have)
+		}
+	}
+}
+
+func TestTxList_CapDrop(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, i := range rand.Perm(10) {
+		list.Add(transaction(uint64(i), 0, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	if dropped := list.CapDrop(10); len(dropped) != 0 {
+		t.Fatalf("expected nothing to be dropped under the limit, have %d", len(dropped))
+	}
+	dropped := list.CapDrop(6)
+	if len(dropped) != 4 {
+		t.Fatalf("expected 4 dropped txs, have %d", len(dropped))
+	}
+	for i, tx := range dropped {
+		if want := uint64(6 + i); tx.Nonce() != want {
+			t.Errorf("tx %d: expected nonce %d but got %d", i, want, tx.Nonce())
+		}
+	}
+	if list.Len() != 6 {
+		t.Errorf("expected 6 txs left, have %d", list.Len())
+	}
+	// Prioritized evictions are still reported in nonce order
+	list = newTxList(false)
+	for nonce, priority := range []uint8{0, 1, 0, 2} {
+		list.txs.PutPriority(transaction(uint64(nonce), 0, key), priority)
+	}
+	dropped = list.CapDrop(1)
+	if have := []uint64{dropped[0].Nonce(), dropped[1].Nonce(), dropped[2].Nonce()}; !reflect.DeepEqual(have, []uint64{0, 1, 2}) {
+		t.Errorf("dropped nonces mismatch: have %v, want [0 1 2]", have)
+	}
+}
+
+// Tests that capping a strict list drops its highest nonce tail even if the
+// transactions in it are prioritized, as a strict list can't have gaps.
+func TestTxList_CapStrictPriority(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(true)
+	for i := 0; i < 4; i++ {
+		list.Add(transaction(uint64(i), 0, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	list.txs.PutPriority(transaction(3, 0, key), 1)
+
+	if drops := list.Cap(2, func(*types.Transaction) {}); drops != 2 {
+		t.Fatalf("drop count mismatch: have %d, want 2", drops)
+	}
+	if want := []uint64{0, 1}; !reflect.DeepEqual(list.txs.Nonces(), want) {
+		t.Errorf("remaining nonces mismatch: have %v, want %v", list.txs.Nonces(), want)
+	}
+	if err := list.txs.invariants(); err != nil {
+		t.Errorf("inconsistent list: %v", err)
+	}
+}
+
+func TestTxList_MaxCost(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxListBounded(false, big.NewInt(1000))
+
+	// Costs are gas + 100 value at a gas price of 1
+	if ok, _ := list.Add(transaction(0, 400, key), DefaultTxPoolConfig.PriceBump, nil); !ok {
+		t.Fatalf("failed to add tx within the budget")
+	}
+	if ok, _ := list.Add(transaction(1, 401, key), DefaultTxPoolConfig.PriceBump, nil); ok {
+		t.Fatalf("added tx exceeding the budget")
+	}
+	if ok, _, reason := list.AddWith(transaction(1, 401, key), txAddOpts{}); ok || reason != RejectedOverBudget {
+		t.Fatalf("expected an over budget rejection, have %v", reason)
+	}
+	if ok, _ := list.Add(transaction(1, 400, key), DefaultTxPoolConfig.PriceBump, nil); !ok {
+		t.Fatalf("failed to add tx exactly filling the budget")
+	}
+	list.SetMaxCost(big.NewInt(500))
+	if ok, _ := list.Add(pricedTransaction(1, 100, big.NewInt(2), key), DefaultTxPoolConfig.PriceBump, nil); !ok {
+		t.Fatalf("failed to replace tx with a cheaper one over the budget")
+	}
+	if ok, _ := list.Add(pricedTransaction(0, 300, big.NewInt(2), key), DefaultTxPoolConfig.PriceBump, nil); ok {
+		t.Fatalf("replaced tx with a more costly one over the budget")
+	}
+	list.SetMaxCost(nil)
+	if ok, _ := list.Add(transaction(2, 1000, key), DefaultTxPoolConfig.PriceBump, nil); !ok {
+		t.Errorf("failed to add tx without a budget")
+	}
+}
+
+func TestTxList_AddDetailed(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	tx := pricedTransaction(0, 100, big.NewInt(10), key)
+
+	if res := list.AddDetailed(tx, DefaultTxPoolConfig.PriceBump, nil); !res.Accepted || res.Replaced != nil || res.Reason != AddAccepted {
+		t.Fatalf("expected a fresh tx to be accepted, have %+v", res)
+	}
+	if res := list.AddDetailed(tx, DefaultTxPoolConfig.PriceBump, nil); res.Accepted || res.Reason != RejectedDuplicate {
+		t.Fatalf("expected a duplicate to be rejected as such, have %+v", res)
+	}
+	if res := list.AddDetailed(pricedTransaction(0, 101, big.NewInt(10), key), DefaultTxPoolConfig.PriceBump, nil); res.Accepted || res.Reason != RejectedUnderpriced {
+		t.Fatalf("expected an equally priced replacement to be rejected as underpriced, have %+v", res)
+	}
+	if res := list.AddDetailed(pricedTransaction(0, 100, big.NewInt(20), key), DefaultTxPoolConfig.PriceBump, nil); !res.Accepted || res.Replaced != tx {
+		t.Errorf("expected a replacement to be accepted, have %+v", res)
+	}
+}
+
+func TestTxList_FlattenByPrice(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	prices := []int64{3, 7, 3, 5}
+	for i, price := range prices {
+		list.Add(pricedTransaction(uint64(i), 100, big.NewInt(price), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	want := []uint64{1, 3, 0, 2}
+	txs := list.FlattenByPrice()
+	if len(txs) != len(want) {
+		t.Fatalf("length mismatch: have %d, want %d", len(txs), len(want))
+	}
+	for i, tx := range txs {
+		if tx.Nonce() != want[i] {
+			t.Errorf("position %d: have nonce %d, want %d", i, tx.Nonce(), want[i])
+		}
+	}
+	// The nonce sorted view must be unaffected by the price ordering
+	for i, tx := range list.Flatten() {
+		if tx.Nonce() != uint64(i) {
+			t.Errorf("nonce order broken at %d: have %d", i, tx.Nonce())
+		}
+	}
+}
+
+func TestTxList_WouldAccept(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	old := pricedTransaction(0, 100, big.NewInt(10), key)
+	list.Add(old, DefaultTxPoolConfig.PriceBump, nil)
+
+	fresh := pricedTransaction(1, 100, big.NewInt(1), key)
+	if ok, replaced := list.WouldAccept(fresh, DefaultTxPoolConfig.PriceBump, nil); !ok || replaced != nil {
+		t.Errorf("new nonce: have %v/%v, want true/nil", ok, replaced)
+	}
+	if ok, _ := list.WouldAccept(pricedTransaction(0, 100, big.NewInt(10), key), DefaultTxPoolConfig.PriceBump, nil); ok {
+		t.Errorf("duplicate reported as acceptable")
+	}
+	if ok, _ := list.WouldAccept(pricedTransaction(0, 101, big.NewInt(10), key), DefaultTxPoolConfig.PriceBump, nil); ok {
+		t.Errorf("underpriced replacement reported as acceptable")
+	}
+	bumped := pricedTransaction(0, 100, big.NewInt(11), key)
+	if ok, replaced := list.WouldAccept(bumped, DefaultTxPoolConfig.PriceBump, nil); !ok || replaced != old {
+		t.Errorf("replacement: have %v/%v, want true/%v", ok, replaced, old)
+	}
+	// The absolute minimum bump must be honoured just like Add does
+	if ok, _ := list.WouldAccept(bumped, DefaultTxPoolConfig.PriceBump, big.NewInt(5)); ok {
+		t.Errorf("replacement below the minimum bump reported as acceptable")
+	}
+	if ok, _ := list.Add(bumped, DefaultTxPoolConfig.PriceBump, big.NewInt(5)); ok {
+		t.Fatalf("replacement below the minimum bump accepted by Add")
+	}
+	// Nothing must have been inserted by the checks
+	if list.Len() != 1 || list.txs.Get(0) != old {
+		t.Errorf("list modified by dry-run checks")
+	}
+}
+
+func TestTxList_Gaps(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for _, nonce := range []uint64{5, 6, 9, 10, 14} {
+		list.Add(transaction(nonce, 0, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	tests := []struct {
+		start uint64
+		want  [][2]uint64
+	}{
+		{5, [][2]uint64{{7, 8}, {11, 13}}},
+		{3, [][2]uint64{{3, 4}, {7, 8}, {11, 13}}},
+		{9, [][2]uint64{{11, 13}}},
+		{14, nil},
+		{20, nil},
+	}
+	for _, tt := range tests {
+		if have := list.Gaps(tt.start); !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("start %d: have %v, want %v", tt.start, have, tt.want)
+		}
+	}
+}
+
+func TestTxList_CapProtectingFront(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	list := newTxList(false)
+	for i := 0; i < 4; i++ {
+		list.Add(transaction(uint64(i), 0, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	// Prioritizing the tail would make a plain Cap evict the front instead
+	list.txs.PutPriority(transaction(4, 0, key), 1)
+	list.txs.PutPriority(transaction(5, 0, key), 1)
+
+	var dropped []uint64
+	list.CapProtectingFront(4, 2, func(tx *types.Transaction) { dropped = append(dropped, tx.Nonce()) })
+	if !reflect.DeepEqual(dropped, []uint64{4, 5}) {
+		t.Errorf("dropped nonces mismatch: have %v, want [4 5]", dropped)
+	}
+	// A threshold below the protected window stops at the window
+	dropped = nil
+	list.CapProtectingFront(0, 2, func(tx *types.Transaction) { dropped = append(dropped, tx.Nonce()) })
+	if !reflect.DeepEqual(dropped, []uint64{2, 3}) {
+		t.Errorf("dropped nonces mismatch: have %v, want [2 3]", dropped)
+	}
+	if list.Len() != 2 || list.txs.Get(0) == nil || list.txs.Get(1) == nil {
+		t.Errorf("protected transactions evicted")
+	}
+}
+
+func TestForwardAll(t *testing.T) {
+	lists := make(map[common.Address]*txList)
+	nonces := make(map[common.Address]uint64)
+	want := make(map[common.Address]int)
+	for i := 0; i < 32; i++ {
+		key, _ := crypto.GenerateKey()
+		addr := crypto.PubkeyToAddress(key.PublicKey)
+		lists[addr] = newTxList(true)
+		for j := 0; j < 10; j++ {
+			lists[addr].Add(transaction(uint64(j), 0, key), DefaultTxPoolConfig.PriceBump, nil)
+		}
+		nonces[addr], want[addr] = uint64(i%11), i%11
+	}
+	// Accounts without a list must be skipped
+	nonces[common.Address{0xff}] = 5
+
+	have := make(map[common.Address]int)
+	ForwardAll(lists, nonces, func(addr common.Address, tx *types.Transaction) {
+		if tx.Nonce() >= nonces[addr] {
+			t.Errorf("%x: forwarded nonce %d at or above %d", addr, tx.Nonce(), nonces[addr])
+		}
+		have[addr]++
+	})
+	for addr, list := range lists {
+		if have[addr] != want[addr] {
+			t.Errorf("%x: removed count mismatch: have %d, want %d", addr, have[addr], want[addr])
+		}
+		if list.Len() != 10-want[addr] {
+			t.Errorf("%x: remaining length mismatch: have %d, want %d", addr, list.Len(), 10-want[addr])
+		}
+	}
+}
+
+func TestTxList_ProtectTopFee(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	noop := func(*types.Transaction) {}
+
+	// Non-strict lists evict around the protected transaction
+	list := newTxList(false)
+	list.ProtectTopFee = true
+	for i := 0; i < 6; i++ {
+		price := int64(1)
+		if i == 4 {
+			price = 50
+		}
+		list.Add(pricedTransaction(uint64(i), 100, big.NewInt(price), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	if drops := list.Cap(2, noop); drops != 4 {
+		t.Fatalf("drop count mismatch: have %d, want 4", drops)
+	}
+	if !list.Has(0) || !list.Has(4) {
+		t.Errorf("protected or lowest transaction evicted: %v", list.txs.Nonces())
+	}
+	// Filtering spares the protected transaction even if unaffordable
+	list.Filter(big.NewInt(0), 0, noop, noop)
+	if list.Len() != 1 || !list.Has(4) {
+		t.Errorf("protected transaction filtered: %v", list.txs.Nonces())
+	}
+	if top := list.txs.Get(4); list.costcap.Cmp(top.Cost()) != 0 || list.gascap != top.Gas() {
+		t.Errorf("caps not covering the spared tx: have %v/%d", list.costcap, list.gascap)
+	}
+	// Once unprotected, the next filter must not short circuit on stale caps
+	list.ProtectTopFee = false
+	list.Filter(big.NewInt(0), 0, noop, noop)
+	if !list.Empty() {
+		t.Errorf("unprotected transaction kept: %v", list.txs.Nonces())
+	}
+
+	// Strict lists keep everything up to the protected transaction
+	list = newTxList(true)
+	list.ProtectTopFee = true
+	for i := 0; i < 6; i++ {
+		price := int64(1)
+		if i == 3 {
+			price = 50
+		}
+		list.Add(pricedTransaction(uint64(i), 100, big.NewInt(price), key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	if drops := list.Cap(2, noop); drops != 2 {
+		t.Fatalf("drop count mismatch: have %d, want 2", drops)
+	}
+	if want := []uint64{0, 1, 2, 3}; !reflect.DeepEqual(list.txs.Nonces(), want) {
+		t.Errorf("remaining nonces mismatch: have %v, want %v", list.txs.Nonces(), want)
+	}
+	// Without protection the plain behaviour applies
+	list.ProtectTopFee = false
+	list.Cap(2, noop)
+	if list.Has(3) {
+		t.Errorf("unprotected transaction kept")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	old, new := newTxList(false), newTxList(false)
+	for _, nonce := range []uint64{0, 1, 2, 4} {
+		old.Add(transaction(nonce, 0, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	// Keep 1 and 4, replace 2, drop 0 and add 3 and 5
+	for _, nonce := range []uint64{1, 3, 4, 5} {
+		new.Add(transaction(nonce, 0, key), DefaultTxPoolConfig.PriceBump, nil)
+	}
+	new.Add(pricedTransaction(2, 0, big.NewInt(2), key), DefaultTxPoolConfig.PriceBump, nil)
+
+	nonces := func(txs types.Transactions) []uint64 {
+		var res []uint64
+		for _, tx := range txs {
+			res = append(res, tx.Nonce())
+		}
+		return res
+	}
+	added, removed, replaced := Diff(old, new)
+	if have := nonces(added); !reflect.DeepEqual(have, []uint64{3, 5}) {
+		t.Errorf("added mismatch: have %v, want [3 5]", have)
+	}
+	if have := nonces(removed); !reflect.DeepEqual(have, []uint64{0}) {
+		t.Errorf("removed mismatch: have %v, want [0]", have)
+	}
+	if len(replaced) != 1 || replaced[0] != new.txs.Get(2) {
+		t.Errorf("replaced mismatch: have %v, want the new nonce 2", nonces(replaced))
+	}
+	// A missing snapshot counts as an empty list
+	if added, removed, replaced := Diff(nil, old); len(added) != 4 || len(removed) != 0 || len(replaced) != 0 {
+		t.Errorf("diff from nil mismatch: %d added, %d removed, %d replaced", len(added), len(removed), len(replaced))
+	}
+}
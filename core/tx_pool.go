@@ -832,7 +832,7 @@ func (pool *TxPool) add(tx *types.Transaction, local bool) (bool, error) {
 	from, _ := types.Sender(pool.signer, tx) // already validated
 	if pending := pool.pending[from]; pending != nil && pending.Overlaps(tx) {
 		// Nonce already pending, check if required price bump is met
-		inserted, old := pending.Add(tx, pool.config.PriceBump)
+		inserted, old, _ := pending.AddWith(tx, pool.addOpts())
 		if !inserted {
 			pendingDiscardCounter.Inc(1)
 			return false, ErrReplaceUnderpriced
@@ -874,6 +874,18 @@ func (pool *TxPool) add(tx *types.Transaction, local bool) (bool, error) {
 	return replace, nil
 }
 
+// addOpts returns the admission parameters of transactions inserted into the
+// account lists at the current head, so frozen nonces thaw as blocks arrive.
+//
+// Caller must hold pool.mu.
+func (pool *TxPool) addOpts() txAddOpts {
+	opts := txAddOpts{priceBump: pool.config.PriceBump}
+	if pool.currentNum != nil {
+		opts.currentBlock = pool.currentNum.Uint64()
+	}
+	return opts
+}
+
 // enqueueTx inserts a new transaction into the non-executable transaction queue.
 //
 // Caller must hold pool.mu.
@@ -883,7 +895,7 @@ func (pool *TxPool) enqueueTx(tx *types.Transaction) (bool, error) {
 	if pool.queue[from] == nil {
 		pool.queue[from] = newTxList(false)
 	}
-	inserted, old := pool.queue[from].Add(tx, pool.config.PriceBump)
+	inserted, old, _ := pool.queue[from].AddWith(tx, pool.addOpts())
 	if !inserted {
 		// An older transaction was better, discard this
 		queuedDiscardCounter.Inc(1)
@@ -923,7 +935,7 @@ func (pool *TxPool) promoteTx(addr common.Address, hash common.Hash, tx *types.T
 	if pool.pending[addr] == nil {
 		pool.pending[addr] = newTxList(true)
 	}
-	inserted, old := pool.pending[addr].Add(tx, pool.config.PriceBump)
+	inserted, old, _ := pool.pending[addr].AddWith(tx, pool.addOpts())
 	if !inserted {
 		// An older transaction was better, discard this
 		pool.all.Remove(hash)
@@ -1238,17 +1250,15 @@ func (pool *TxPool) promoteExecutable(addr common.Address, queued *txList) {
 	if !pool.locals.contains(addr) {
 		remove := func(tx *types.Transaction) {
 			pool.all.Remove(tx.Hash())
-			queuedRateLimitCounter.Inc(1)
 		}
 		if tracing {
 			remove = func(tx *types.Transaction) {
 				hash := tx.Hash()
 				pool.all.Remove(hash)
-				queuedRateLimitCounter.Inc(1)
 				log.Trace("Removed cap-exceeding queued transaction", "hash", hash)
 			}
 		}
-		queued.Cap(int(pool.config.AccountQueue), remove)
+		queuedRateLimitCounter.Inc(int64(queued.Cap(int(pool.config.AccountQueue), remove)))
 	}
 
 	// Delete the entire queued entry if it became empty.
@@ -0,0 +1,63 @@
+// Copyright 2026 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package heaputil contains reusable heap.Interface implementations.
+package heaputil
+
+// Uint64Heap is a heap.Interface implementation over 64bit unsigned integers,
+// popping the lowest value first. It is meant to be driven by container/heap.
+type Uint64Heap struct {
+	Values []uint64 // Heap ordered values
+
+	// SetIndex is an optional callback invoked whenever a value moves within
+	// the heap, with an index of -1 when the value is popped off. It allows
+	// tracking the positions of values for heap.Fix and heap.Remove.
+	SetIndex func(value uint64, index int)
+}
+
+func (h *Uint64Heap) Len() int           { return len(h.Values) }
+func (h *Uint64Heap) Less(i, j int) bool { return h.Values[i] < h.Values[j] }
+
+func (h *Uint64Heap) Swap(i, j int) {
+	h.Values[i], h.Values[j] = h.Values[j], h.Values[i]
+	if h.SetIndex != nil {
+		h.SetIndex(h.Values[i], i)
+		h.SetIndex(h.Values[j], j)
+	}
+}
+
+func (h *Uint64Heap) Push(x interface{}) {
+	value := x.(uint64)
+	if h.SetIndex != nil {
+		h.SetIndex(value, len(h.Values))
+	}
+	h.Values = append(h.Values, value)
+}
+
+func (h *Uint64Heap) Pop() interface{} {
+	n := len(h.Values)
+	x := h.Values[n-1]
+	h.Values = h.Values[0 : n-1]
+	if h.SetIndex != nil {
+		h.SetIndex(x, -1)
+	}
+	return x
+}
+
+// Peek returns the lowest value without removing it. The heap must not be empty.
+func (h *Uint64Heap) Peek() uint64 {
+	return h.Values[0]
+}
@@ -0,0 +1,56 @@
+// Copyright 2026 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package heaputil
+
+import (
+	"container/heap"
+	"math/rand"
+	"testing"
+)
+
+func TestUint64Heap(t *testing.T) {
+	pos := make(map[uint64]int)
+	h := &Uint64Heap{SetIndex: func(value uint64, index int) {
+		if index < 0 {
+			delete(pos, value)
+		} else {
+			pos[value] = index
+		}
+	}}
+	for _, v := range rand.Perm(100) {
+		heap.Push(h, uint64(v))
+	}
+	if h.Peek() != 0 {
+		t.Fatalf("expected 0 on top, have %d", h.Peek())
+	}
+	for v := uint64(0); v < 100; v += 2 {
+		heap.Remove(h, pos[v])
+	}
+	for value, i := range pos {
+		if h.Values[i] != value {
+			t.Fatalf("value %d: position %d holds %d", value, i, h.Values[i])
+		}
+	}
+	for want := uint64(1); want < 100; want += 2 {
+		if v := heap.Pop(h).(uint64); v != want {
+			t.Fatalf("expected %d, popped %d", want, v)
+		}
+	}
+	if h.Len() != 0 || len(pos) != 0 {
+		t.Errorf("expected an empty heap, have %d values and %d positions", h.Len(), len(pos))
+	}
+}